@@ -0,0 +1,402 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setHeader returns middleware that sets the header field name to the value
+// returned by value on every request.
+func setHeader(name string, value func() string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// RoundTrippers must not modify the request
+			req := r.Clone(r.Context())
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.Header.Set(name, value())
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// BearerAuth returns middleware that authorizes every request with the
+// static bearer token token, replacing any Authorization header field.
+func BearerAuth(token string) func(http.RoundTripper) http.RoundTripper {
+	return setHeader("Authorization", func() string { return "Bearer " + token })
+}
+
+// BasicAuth returns middleware that authorizes every request with username
+// and password using HTTP Basic authentication, replacing any Authorization
+// header field.
+func BasicAuth(username, password string) func(http.RoundTripper) http.RoundTripper {
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth(username, password)
+	credentials := r.Header.Get("Authorization")
+
+	return setHeader("Authorization", func() string { return credentials })
+}
+
+// APIKeyLocation selects where APIKey puts the key.
+type APIKeyLocation int
+
+const (
+	// APIKeyHeader puts the key in a header field.
+	APIKeyHeader APIKeyLocation = iota
+	// APIKeyQuery puts the key in a query parameter.
+	APIKeyQuery
+)
+
+// APIKey returns middleware that sets key on every request as the header
+// field or query parameter name, as selected by in, replacing any value
+// already set.
+func APIKey(name, key string, in APIKeyLocation) func(http.RoundTripper) http.RoundTripper {
+	if in == APIKeyHeader {
+		return setHeader(name, func() string { return key })
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// RoundTrippers must not modify the request; Clone copies the URL
+			req := r.Clone(r.Context())
+			req.URL.RawQuery = setQueryParam(req.URL.RawQuery, name, key)
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// setQueryParam returns rawQuery without any parameter name and with name set
+// to value at its end. The other parameters are kept as they are, in order
+// and with their encoding.
+func setQueryParam(rawQuery, name, value string) string {
+	var params []string
+	for param := range strings.SplitSeq(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if param != "" && key != name {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(append(params, url.QueryEscape(name)+"="+url.QueryEscape(value)), "&")
+}
+
+// Token is an access token issued by an authorization server.
+type Token struct {
+	AccessToken string
+	TokenType   string    // "Bearer" if empty
+	Expiry      time.Time // zero if the token does not expire
+}
+
+// authorization returns the Authorization header field value for t.
+func (t *Token) authorization() string {
+	tokenType := t.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + t.AccessToken
+}
+
+// TokenSource is the interface implemented by an object that supplies access
+// tokens. Token must be safe for concurrent use.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// TokenInvalidator is the interface implemented by a TokenSource that can
+// discard a token the server rejected, so that the next call to Token gets
+// a new one.
+type TokenInvalidator interface {
+	Invalidate(token *Token)
+}
+
+// TokenAuth returns middleware that authorizes every request with a token
+// from source, replacing any Authorization header field.
+//
+// If the server answers 401 Unauthorized and source implements
+// TokenInvalidator, the token is invalidated and the request is retried once
+// with a new token. A request whose body cannot be replayed with GetBody is
+// not retried.
+func TokenAuth(source TokenSource) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			token, err := source.Token(r.Context())
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := next.RoundTrip(authorize(r, token))
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+
+			invalidator, ok := source.(TokenInvalidator)
+			replayable := r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+			if !ok || !replayable {
+				return resp, nil
+			}
+			invalidator.Invalidate(token)
+
+			retry, err := source.Token(r.Context())
+			if err != nil {
+				// the 401 is more telling than a failed refresh
+				return resp, nil
+			}
+			req := authorize(r, retry)
+			if r.GetBody != nil {
+				if req.Body, err = r.GetBody(); err != nil {
+					return resp, nil
+				}
+			}
+
+			// drain the body so that the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// authorize returns a clone of r authorized with token.
+func authorize(r *http.Request, token *Token) *http.Request {
+	// RoundTrippers must not modify the request
+	req := r.Clone(r.Context())
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Authorization", token.authorization())
+	return req
+}
+
+// clientCredentialsOptions holds the optional configuration of a
+// ClientCredentials token source.
+type clientCredentialsOptions struct {
+	scopes    []string
+	transport http.RoundTripper
+	clock     Clock
+	early     time.Duration
+	timeout   time.Duration
+}
+
+// ClientCredentialsOption is a function that sets a ClientCredentials option.
+type ClientCredentialsOption func(*clientCredentialsOptions)
+
+// WithClientCredentialsScopes sets the scopes ClientCredentials requests.
+func WithClientCredentialsScopes(scopes ...string) ClientCredentialsOption {
+	return func(o *clientCredentialsOptions) { o.scopes = scopes }
+}
+
+// WithClientCredentialsTransport sets ClientCredentials to request tokens
+// through transport.
+func WithClientCredentialsTransport(transport http.RoundTripper) ClientCredentialsOption {
+	return func(o *clientCredentialsOptions) { o.transport = transport }
+}
+
+// WithClientCredentialsClock sets ClientCredentials to tell time using clock.
+func WithClientCredentialsClock(clock Clock) ClientCredentialsOption {
+	return func(o *clientCredentialsOptions) { o.clock = clock }
+}
+
+// WithClientCredentialsEarlyRefresh sets how long before its expiry
+// ClientCredentials starts refreshing a token in the background.
+func WithClientCredentialsEarlyRefresh(early time.Duration) ClientCredentialsOption {
+	return func(o *clientCredentialsOptions) { o.early = early }
+}
+
+// WithClientCredentialsTimeout sets how long ClientCredentials waits for the
+// token endpoint to answer a token request. The timer runs on real time, not
+// the ClientCredentials clock. A timeout of 0 means the default.
+func WithClientCredentialsTimeout(timeout time.Duration) ClientCredentialsOption {
+	return func(o *clientCredentialsOptions) { o.timeout = timeout }
+}
+
+// ClientCredentials is a TokenSource that gets tokens from an OAuth 2.0
+// authorization server with the client credentials grant of RFC 6749. It
+// caches the token and refreshes it in the background shortly before it
+// expires; concurrent callers share a single refresh. It is safe for
+// concurrent use.
+type ClientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	options      clientCredentialsOptions
+
+	token      *Token
+	refreshing *tokenFlight
+	mutex      sync.Mutex
+}
+
+// tokenFlight is a token request shared by concurrent callers.
+type tokenFlight struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// NewClientCredentials returns a ClientCredentials that requests tokens from
+// tokenURL, authenticating as clientID with clientSecret. By default, it
+// requests no scopes, uses http.DefaultTransport and SystemClock, refreshes
+// a token 30 seconds before it expires, and gives up on a token request after
+// 30 seconds.
+func NewClientCredentials(tokenURL, clientID, clientSecret string, opts ...ClientCredentialsOption) *ClientCredentials {
+	o := clientCredentialsOptions{transport: http.DefaultTransport, clock: SystemClock{}, early: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// a hung token endpoint must not hold the shared request forever
+	if o.timeout <= 0 {
+		o.timeout = 30 * time.Second
+	}
+
+	return &ClientCredentials{tokenURL: tokenURL, clientID: clientID, clientSecret: clientSecret, options: o}
+}
+
+// Token returns the cached token until it expires, starting a background
+// refresh once it is about to. It waits for a new token only if there is none
+// or it has expired; a failed background refresh keeps the cached token. A
+// caller whose context is done stops waiting for a shared request with its
+// context error, without canceling the request.
+func (c *ClientCredentials) Token(ctx context.Context) (*Token, error) {
+	c.mutex.Lock()
+	if c.token != nil && !c.expired(c.token) {
+		token := c.token
+		if c.stale(token) {
+			c.startRefresh(ctx)
+		}
+		c.mutex.Unlock()
+		return token, nil
+	}
+	f := c.startRefresh(ctx)
+	c.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Invalidate discards token if it is the cached token. Tokens cached since
+// are kept, so concurrent rejections of one token cause a single refresh.
+func (c *ClientCredentials) Invalidate(token *Token) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token == token {
+		c.token = nil
+	}
+}
+
+// Transport returns middleware that authorizes requests with tokens from c;
+// it is short for TokenAuth(c).
+func (c *ClientCredentials) Transport(next http.RoundTripper) http.RoundTripper {
+	return TokenAuth(c)(next)
+}
+
+// expired reports whether token can no longer be used.
+func (c *ClientCredentials) expired(token *Token) bool {
+	return !token.Expiry.IsZero() && !c.options.clock.Now().Before(token.Expiry)
+}
+
+// stale reports whether token is close enough to expiry to be refreshed.
+func (c *ClientCredentials) stale(token *Token) bool {
+	return !token.Expiry.IsZero() && !c.options.clock.Now().Add(c.options.early).Before(token.Expiry)
+}
+
+// startRefresh returns the running refresh, starting one if there is none.
+// The caller must hold c.mutex.
+func (c *ClientCredentials) startRefresh(ctx context.Context) *tokenFlight {
+	if c.refreshing == nil {
+		c.refreshing = &tokenFlight{done: make(chan struct{})}
+		// the shared request must outlive any one caller
+		go c.refresh(context.WithoutCancel(ctx), c.refreshing)
+	}
+	return c.refreshing
+}
+
+// refresh requests a token for f, within the timeout, and caches it on
+// success.
+func (c *ClientCredentials) refresh(ctx context.Context, f *tokenFlight) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.timeout)
+	defer cancel()
+
+	f.token, f.err = c.fetch(ctx)
+
+	c.mutex.Lock()
+	if f.err == nil {
+		c.token = f.token
+	}
+	c.refreshing = nil
+	c.mutex.Unlock()
+
+	close(f.done)
+}
+
+// tokenResponse is the JSON body of a token endpoint response, successful or
+// not, as defined in RFC 6749.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// fetch requests a token from the token endpoint.
+func (c *ClientCredentials) fetch(ctx context.Context) (*Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.options.scopes) > 0 {
+		form.Set("scope", strings.Join(c.options.scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 requires the credentials to be form-encoded before Basic
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	requestTime := c.options.clock.Now()
+	resp, err := c.options.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body tokenResponse
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+
+	switch {
+	case resp.StatusCode != http.StatusOK && body.Error != "":
+		return nil, fmt.Errorf("token request: got status %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("token request: got status %d", resp.StatusCode)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("token request: invalid response: %w", decodeErr)
+	case body.AccessToken == "":
+		return nil, fmt.Errorf("token request: response has no access token")
+	}
+
+	token := &Token{AccessToken: body.AccessToken, TokenType: body.TokenType}
+	if body.ExpiresIn > 0 {
+		// measure from the request so the token never outlives its grant
+		token.Expiry = requestTime.Add(seconds(body.ExpiresIn))
+	}
+	return token, nil
+}
@@ -0,0 +1,387 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+func TestStaticAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       func(http.RoundTripper) http.RoundTripper
+		rawQuery   string // "q=1" if empty
+		wantHeader string
+		wantValue  string
+		wantQuery  string
+	}{
+		{
+			name:       "must_set_bearer_token",
+			auth:       BearerAuth("secret"),
+			wantHeader: "Authorization",
+			wantValue:  "Bearer secret",
+		},
+		{
+			name:       "must_set_basic_credentials",
+			auth:       BasicAuth("user", "pass"),
+			wantHeader: "Authorization",
+			wantValue:  "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")),
+		},
+		{
+			name:       "must_set_api_key_header",
+			auth:       APIKey("X-API-Key", "secret", APIKeyHeader),
+			wantHeader: "X-API-Key",
+			wantValue:  "secret",
+		},
+		{
+			name:      "must_set_api_key_query",
+			auth:      APIKey("key", "a b", APIKeyQuery),
+			wantQuery: "q=1&key=a+b",
+		},
+		{
+			name:      "must_replace_api_key_query_keeping_other_params",
+			auth:      APIKey("key", "new", APIKeyQuery),
+			rawQuery:  "z=a%20b&key=old&a=1&k%65y=old2",
+			wantQuery: "z=a%20b&a=1&key=new",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				got = r
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+			})
+
+			rawQuery := tt.rawQuery
+			if rawQuery == "" {
+				rawQuery = "q=1"
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/?"+rawQuery, nil)
+			if _, err := tt.auth(tripper).RoundTrip(r); err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+
+			if tt.wantHeader != "" {
+				if v := got.Header.Get(tt.wantHeader); v != tt.wantValue {
+					t.Errorf("got %v '%v', want '%v'", tt.wantHeader, v, tt.wantValue)
+				}
+				if r.Header.Get(tt.wantHeader) != "" {
+					t.Errorf("got caller's request modified, want unchanged")
+				}
+			}
+			if tt.wantQuery != "" {
+				if q := got.URL.RawQuery; q != tt.wantQuery {
+					t.Errorf("got query '%v', want '%v'", q, tt.wantQuery)
+				}
+				if r.URL.RawQuery != rawQuery {
+					t.Errorf("got caller's request modified, want unchanged")
+				}
+			}
+		})
+	}
+}
+
+// tokenServer is an OAuth 2.0 token endpoint that issues numbered tokens,
+// holding each response until release is closed, if set.
+type tokenServer struct {
+	*httptest.Server
+	issued    atomic.Int32
+	expiresIn int
+	release   chan struct{}
+	form      chan string
+}
+
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"invalid_client"}`)
+			return
+		}
+		r.ParseForm()
+		if s.form != nil {
+			s.form <- r.Form.Encode()
+		}
+		if s.release != nil {
+			<-s.release
+		}
+		n := s.issued.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, s.expiresIn)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestClientCredentials_Token(t *testing.T) {
+	server := newTokenServer(t, 300)
+	server.form = make(chan string, 1)
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := NewClientCredentials(server.URL, "client", "s3cret",
+		WithClientCredentialsScopes("read", "write"),
+		WithClientCredentialsClock(clock),
+		WithClientCredentialsEarlyRefresh(time.Minute))
+
+	token, err := source.Token(context.Background())
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if want := "grant_type=client_credentials&scope=read+write"; <-server.form != want {
+		t.Errorf("got form other than '%v'", want)
+	}
+	if token.AccessToken != "token-1" {
+		t.Errorf("got token '%v', want 'token-1'", token.AccessToken)
+	}
+	if want := clock.Now().Add(300 * time.Second); !token.Expiry.Equal(want) {
+		t.Errorf("got expiry %v, want %v", token.Expiry, want)
+	}
+
+	server.form = nil
+	server.release = make(chan struct{})
+	steps := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{advance: 0, want: "token-1"},
+		{advance: 239 * time.Second, want: "token-1"},
+		{advance: time.Second, want: "token-1"}, // within a minute of expiry
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		token, err := source.Token(context.Background())
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		if token.AccessToken != step.want {
+			t.Errorf("got token '%v', want '%v'", token.AccessToken, step.want)
+		}
+	}
+
+	// the background refresh replaces the token once it succeeds
+	close(server.release)
+	waitForRefresh(t, source)
+	if token, _ := source.Token(context.Background()); token.AccessToken != "token-2" {
+		t.Errorf("got token '%v', want 'token-2'", token.AccessToken)
+	}
+	if got := server.issued.Load(); got != 2 {
+		t.Errorf("got %v tokens issued, want 2", got)
+	}
+}
+
+// waitForRefresh blocks until source has no refresh running.
+func waitForRefresh(t *testing.T, source *ClientCredentials) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); ; {
+		source.mutex.Lock()
+		running := source.refreshing != nil
+		source.mutex.Unlock()
+
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got refresh still running, want done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientCredentials_Token_RefreshError(t *testing.T) {
+	var calls atomic.Int32
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if calls.Add(1) > 1 {
+			return nil, fmt.Errorf("simulated network error")
+		}
+		body := `{"access_token":"token-1","token_type":"bearer","expires_in":300}`
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+	})
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := NewClientCredentials("http://example.com/token", "client", "s3cret",
+		WithClientCredentialsTransport(tripper),
+		WithClientCredentialsClock(clock),
+		WithClientCredentialsEarlyRefresh(time.Minute))
+
+	if _, err := source.Token(context.Background()); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	// a failed refresh keeps the token until it expires
+	clock.Advance(240 * time.Second)
+	for i := range 2 {
+		token, err := source.Token(context.Background())
+		if err != nil || token.AccessToken != "token-1" {
+			t.Errorf("call %d: got token %v and error %v, want 'token-1'", i+1, token, err)
+		}
+		waitForRefresh(t, source)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("got %v token requests, want 3", got)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := source.Token(context.Background()); err == nil || !strings.Contains(err.Error(), "simulated network error") {
+		t.Errorf("got error %v, want simulated network error", err)
+	}
+}
+
+func TestClientCredentials_Token_Error(t *testing.T) {
+	server := newTokenServer(t, 300)
+	source := NewClientCredentials(server.URL, "client", "wrong")
+
+	_, err := source.Token(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("got error %v, want invalid_client", err)
+	}
+}
+
+func TestClientCredentials_Timeout(t *testing.T) {
+	var calls atomic.Int32
+	hung := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	source := NewClientCredentials("http://example.com/token", "client", "s3cret",
+		WithClientCredentialsTransport(hung),
+		WithClientCredentialsTimeout(10*time.Millisecond))
+
+	// a hung request times out, and the next call makes a new one
+	for i := range 2 {
+		if _, err := source.Token(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("call %d: got error %v, want %v", i+1, err, context.DeadlineExceeded)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %v token requests, want 2", got)
+	}
+}
+
+func TestClientCredentials_SingleFlight(t *testing.T) {
+	const callers = 10
+
+	server := newTokenServer(t, 300)
+	server.release = make(chan struct{})
+	source := NewClientCredentials(server.URL, "client", "s3cret")
+
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := source.Token(context.Background())
+			if err != nil {
+				t.Errorf("got error %v, want nil", err)
+				return
+			}
+			if token.AccessToken != "token-1" {
+				t.Errorf("got token '%v', want 'token-1'", token.AccessToken)
+			}
+		}()
+	}
+
+	// a caller leaving must not cancel the shared request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := source.Token(ctx); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	time.Sleep(10 * time.Millisecond) // let every caller join the request
+	close(server.release)
+	wg.Wait()
+
+	if got := server.issued.Load(); got != 1 {
+		t.Errorf("got %v tokens issued, want 1", got)
+	}
+}
+
+func TestTokenAuth_Unauthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		accepted   string // the token the API accepts
+		body       io.Reader
+		wantStatus int
+		wantCalls  int32
+		wantIssued int32
+	}{
+		{name: "must_not_retry_success", accepted: "token-1", wantStatus: http.StatusOK, wantCalls: 1, wantIssued: 1},
+		{name: "must_retry_once_with_new_token", accepted: "token-2", wantStatus: http.StatusOK, wantCalls: 2, wantIssued: 2},
+		{name: "must_retry_with_body", accepted: "token-2", body: strings.NewReader("x"), wantStatus: http.StatusOK, wantCalls: 2, wantIssued: 2},
+		{name: "must_give_up_after_one_retry", accepted: "token-3", wantStatus: http.StatusUnauthorized, wantCalls: 2, wantIssued: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTokenServer(t, 300)
+			source := NewClientCredentials(server.URL, "client", "s3cret")
+
+			var calls atomic.Int32
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				if r.Body != nil {
+					if data, _ := io.ReadAll(r.Body); tt.body != nil && string(data) != "x" {
+						t.Errorf("got body '%s', want 'x'", data)
+					}
+				}
+				status := http.StatusUnauthorized
+				if r.Header.Get("Authorization") == "Bearer "+tt.accepted {
+					status = http.StatusOK
+				}
+				return &http.Response{StatusCode: status, Body: http.NoBody, Request: r}, nil
+			})
+
+			r, _ := http.NewRequest(http.MethodPost, "http://example.com/", tt.body)
+			resp, err := source.Transport(tripper).RoundTrip(r)
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("got %v calls, want %v", got, tt.wantCalls)
+			}
+			if got := server.issued.Load(); got != tt.wantIssued {
+				t.Errorf("got %v tokens issued, want %v", got, tt.wantIssued)
+			}
+		})
+	}
+}
+
+func TestClientCredentials_Invalidate(t *testing.T) {
+	server := newTokenServer(t, 0)
+	source := NewClientCredentials(server.URL, "client", "s3cret")
+
+	first, _ := source.Token(context.Background())
+	if !first.Expiry.IsZero() {
+		t.Errorf("got expiry %v, want none", first.Expiry)
+	}
+	source.Invalidate(first)
+	second, _ := source.Token(context.Background())
+
+	// a stale rejection must not discard the newer token
+	source.Invalidate(first)
+	if third, _ := source.Token(context.Background()); third != second {
+		t.Errorf("got token '%v', want '%v'", third.AccessToken, second.AccessToken)
+	}
+	if got := server.issued.Load(); got != 2 {
+		t.Errorf("got %v tokens issued, want 2", got)
+	}
+}
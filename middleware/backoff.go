@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Backoff is the interface implemented by an object that chooses the delay
+// before a retry. Delay is called with the number of the attempt that just
+// failed, starting at 1, the delay that preceded it, 0 for the first, and a
+// source of jitter.
+//
+// The implementations in this package never panic: an attempt of 0 is
+// treated as 1 and invalid fields are clamped. Use their Validate methods, or
+// RetryPolicy.Validate, to catch misconfiguration early.
+type Backoff interface {
+	Delay(attempt uint, prev time.Duration, jitter JitterSource) time.Duration
+}
+
+// DefaultBackoff is used if no backoff is supplied in a RetryPolicy.
+var DefaultBackoff Backoff = ExponentialBackoff{Base: 100 * time.Millisecond, Max: 10 * time.Second}
+
+// ExponentialBackoff doubles Base with every attempt, clamped to Max, with
+// random jitter +-10% to prevent simultaneous retries.
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b ExponentialBackoff) Delay(attempt uint, _ time.Duration, jitter JitterSource) time.Duration {
+	d := exponential(b.Base, b.Max, attempt)
+
+	// -10%...+10%, without overflowing
+	lo := d - d/10
+	return lo + randN(jitter, min(d/5, math.MaxInt64-lo))
+}
+
+// Validate returns an error if Base is not positive or Max is below Base.
+func (b ExponentialBackoff) Validate() error { return validateRange(b.Base, b.Max) }
+
+// FullJitterBackoff waits a random duration between 0 and the exponential
+// backoff of Base, clamped to Max. It spreads retries the most, at the cost
+// of occasional near-immediate retries.
+type FullJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b FullJitterBackoff) Delay(attempt uint, _ time.Duration, jitter JitterSource) time.Duration {
+	return randN(jitter, exponential(b.Base, b.Max, attempt)+1)
+}
+
+// Validate returns an error if Base is not positive or Max is below Base.
+func (b FullJitterBackoff) Validate() error { return validateRange(b.Base, b.Max) }
+
+// EqualJitterBackoff waits half the exponential backoff of Base, clamped to
+// Max, plus a random duration up to the other half.
+type EqualJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b EqualJitterBackoff) Delay(attempt uint, _ time.Duration, jitter JitterSource) time.Duration {
+	d := exponential(b.Base, b.Max, attempt)
+
+	return d - d/2 + randN(jitter, d/2+1)
+}
+
+// Validate returns an error if Base is not positive or Max is below Base.
+func (b EqualJitterBackoff) Validate() error { return validateRange(b.Base, b.Max) }
+
+// DecorrelatedJitterBackoff waits a random duration between Base and three
+// times the previous delay, clamped to Max. As each delay derives from the
+// last rather than the attempt count, concurrent clients drift apart instead
+// of retrying in step.
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b DecorrelatedJitterBackoff) Delay(_ uint, prev time.Duration, jitter JitterSource) time.Duration {
+	base, ceil := max(b.Base, 0), max(b.Max, 0)
+	hi := max(prev, base)
+	if hi > ceil/3 {
+		hi = ceil
+	} else {
+		hi *= 3
+	}
+
+	return min(base+randN(jitter, hi-base+1), ceil)
+}
+
+// Validate returns an error if Base is not positive or Max is below Base.
+func (b DecorrelatedJitterBackoff) Validate() error { return validateRange(b.Base, b.Max) }
+
+// ConstantBackoff always waits the same duration.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Delay(uint, time.Duration, JitterSource) time.Duration {
+	return max(time.Duration(b), 0)
+}
+
+// Validate returns an error if the duration is negative.
+func (b ConstantBackoff) Validate() error {
+	if b < 0 {
+		return fmt.Errorf("invalid backoff: duration %v is negative", time.Duration(b))
+	}
+	return nil
+}
+
+// LinearBackoff waits Base plus Step for every attempt after the first,
+// clamped to Max.
+type LinearBackoff struct {
+	Base time.Duration
+	Step time.Duration
+	Max  time.Duration
+}
+
+func (b LinearBackoff) Delay(attempt uint, _ time.Duration, _ JitterSource) time.Duration {
+	base, step, ceil := max(b.Base, 0), max(b.Step, 0), max(b.Max, 0)
+
+	d := base
+	if n := max(attempt, 1) - 1; n > 0 && step > 0 {
+		if time.Duration(n) > (ceil-base)/step {
+			return ceil
+		}
+		d += time.Duration(n) * step
+	}
+
+	return min(d, ceil)
+}
+
+// Validate returns an error if Base or Step is negative or Max is below Base.
+func (b LinearBackoff) Validate() error {
+	if b.Base < 0 {
+		return fmt.Errorf("invalid backoff: base %v is negative", b.Base)
+	}
+	if b.Step < 0 {
+		return fmt.Errorf("invalid backoff: step %v is negative", b.Step)
+	}
+	if b.Max < b.Base {
+		return fmt.Errorf("invalid backoff: max %v is below base %v", b.Max, b.Base)
+	}
+	return nil
+}
+
+// exponential returns base doubled once for every attempt after the first,
+// clamped to max. It returns 0 if base or max is not positive.
+func exponential(base, max time.Duration, attempt uint) time.Duration {
+	if base <= 0 || max <= 0 {
+		return 0
+	}
+
+	d := base
+	for n := uint(1); n < attempt && d < max; n++ {
+		if d > max/2 {
+			return max
+		}
+		d *= 2
+	}
+
+	return min(d, max)
+}
+
+// randN returns a random duration in [0,n) drawn from jitter, or 0 if n is not
+// positive.
+func randN(jitter JitterSource, n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(jitter.Int64N(int64(n)))
+}
+
+// validateRange returns an error if base is not positive or max is below base.
+func validateRange(base, max time.Duration) error {
+	if base <= 0 {
+		return fmt.Errorf("invalid backoff: base %v must be positive", base)
+	}
+	if max < base {
+		return fmt.Errorf("invalid backoff: max %v is below base %v", max, base)
+	}
+	return nil
+}
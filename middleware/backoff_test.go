@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	const base, max = 100 * time.Millisecond, 1 * time.Second
+
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt uint
+		prev    time.Duration
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "exponential_must_jitter_10_percent", backoff: ExponentialBackoff{Base: base, Max: max}, attempt: 2, wantMin: 180 * time.Millisecond, wantMax: 220 * time.Millisecond},
+		{name: "exponential_must_clamp_to_max", backoff: ExponentialBackoff{Base: base, Max: max}, attempt: 10, wantMin: 900 * time.Millisecond, wantMax: 1100 * time.Millisecond},
+		{name: "exponential_must_not_overflow", backoff: ExponentialBackoff{Base: base, Max: math.MaxInt64}, attempt: math.MaxUint32, wantMin: math.MaxInt64 / 10 * 9, wantMax: math.MaxInt64},
+		{name: "exponential_must_not_panic_on_small_base", backoff: ExponentialBackoff{Base: 1, Max: 1}, attempt: 1, wantMin: 1, wantMax: 1},
+		{name: "exponential_must_not_panic_on_zero", backoff: ExponentialBackoff{}, attempt: 0, wantMin: 0, wantMax: 0},
+		{name: "full_jitter_must_be_within_zero_and_exponential", backoff: FullJitterBackoff{Base: base, Max: max}, attempt: 3, wantMin: 0, wantMax: 400 * time.Millisecond},
+		{name: "full_jitter_must_not_panic_on_zero", backoff: FullJitterBackoff{}, attempt: 1, wantMin: 0, wantMax: 0},
+		{name: "equal_jitter_must_be_within_half_and_exponential", backoff: EqualJitterBackoff{Base: base, Max: max}, attempt: 3, wantMin: 200 * time.Millisecond, wantMax: 400 * time.Millisecond},
+		{name: "equal_jitter_must_not_panic_on_zero", backoff: EqualJitterBackoff{}, attempt: 1, wantMin: 0, wantMax: 0},
+		{name: "decorrelated_must_start_from_base", backoff: DecorrelatedJitterBackoff{Base: base, Max: max}, attempt: 1, wantMin: base, wantMax: 3 * base},
+		{name: "decorrelated_must_grow_from_prev", backoff: DecorrelatedJitterBackoff{Base: base, Max: max}, attempt: 2, prev: 200 * time.Millisecond, wantMin: base, wantMax: 600 * time.Millisecond},
+		{name: "decorrelated_must_clamp_to_max", backoff: DecorrelatedJitterBackoff{Base: base, Max: max}, attempt: 5, prev: math.MaxInt64, wantMin: base, wantMax: max},
+		{name: "decorrelated_must_not_panic_on_zero", backoff: DecorrelatedJitterBackoff{}, attempt: 1, wantMin: 0, wantMax: 0},
+		{name: "constant_must_be_constant", backoff: ConstantBackoff(base), attempt: 7, wantMin: base, wantMax: base},
+		{name: "constant_must_clamp_negative_to_zero", backoff: ConstantBackoff(-base), attempt: 1, wantMin: 0, wantMax: 0},
+		{name: "linear_must_add_step", backoff: LinearBackoff{Base: base, Step: base, Max: max}, attempt: 3, wantMin: 300 * time.Millisecond, wantMax: 300 * time.Millisecond},
+		{name: "linear_must_clamp_to_max", backoff: LinearBackoff{Base: base, Step: base, Max: max}, attempt: math.MaxUint32, wantMin: max, wantMax: max},
+		{name: "linear_must_treat_attempt_zero_as_one", backoff: LinearBackoff{Base: base, Step: base, Max: max}, attempt: 0, wantMin: base, wantMax: base},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jitter := NewJitterSource(1)
+			for range 100 {
+				got := tt.backoff.Delay(tt.attempt, tt.prev, jitter)
+				if got < tt.wantMin || got > tt.wantMax {
+					t.Fatalf("got duration %v, want >= %v and <= %v", got, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff interface{ Validate() error }
+		wantErr bool
+	}{
+		{name: "must_pass_on_valid_exponential", backoff: ExponentialBackoff{Base: 1, Max: 1}},
+		{name: "must_error_on_exponential_base_zero", backoff: ExponentialBackoff{Max: 1}, wantErr: true},
+		{name: "must_error_on_full_jitter_max_below_base", backoff: FullJitterBackoff{Base: 2, Max: 1}, wantErr: true},
+		{name: "must_error_on_equal_jitter_base_zero", backoff: EqualJitterBackoff{Max: 1}, wantErr: true},
+		{name: "must_error_on_decorrelated_max_below_base", backoff: DecorrelatedJitterBackoff{Base: 2, Max: 1}, wantErr: true},
+		{name: "must_pass_on_constant_zero", backoff: ConstantBackoff(0)},
+		{name: "must_error_on_constant_negative", backoff: ConstantBackoff(-1), wantErr: true},
+		{name: "must_pass_on_valid_linear", backoff: LinearBackoff{Step: 1, Max: 1}},
+		{name: "must_error_on_linear_base_negative", backoff: LinearBackoff{Base: -1}, wantErr: true},
+		{name: "must_error_on_linear_step_negative", backoff: LinearBackoff{Step: -1}, wantErr: true},
+		{name: "must_error_on_linear_max_below_base", backoff: LinearBackoff{Base: 2, Max: 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (tt.backoff.Validate() != nil); got != tt.wantErr {
+				t.Errorf("got error %v, want %v", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		wantErr bool
+	}{
+		{name: "must_pass_on_zero_value", policy: RetryPolicy{}},
+		{name: "must_error_on_max_elapsed_negative", policy: RetryPolicy{MaxElapsed: -1}, wantErr: true},
+		{name: "must_error_on_invalid_backoff", policy: RetryPolicy{Backoff: ExponentialBackoff{}}, wantErr: true},
+		{name: "must_pass_on_valid_backoff", policy: RetryPolicy{Backoff: ConstantBackoff(time.Second)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (tt.policy.Validate() != nil); got != tt.wantErr {
+				t.Errorf("got error %v, want %v", got, tt.wantErr)
+			}
+		})
+	}
+}
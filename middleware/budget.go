@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// budgetBuckets is the number of buckets a RetryBudget window is split into.
+const budgetBuckets = 10
+
+// budgetBucket counts the deposits and withdrawals within one slice of a
+// RetryBudget window. epoch identifies the slice the counts belong to.
+type budgetBucket struct {
+	epoch       int64
+	deposits    float64
+	withdrawals float64
+}
+
+// RetryBudget limits retries to a ratio of recent successful requests, plus a
+// minimum number of retries per second, to prevent retry storms against a
+// failing upstream. It is modeled on Finagle's RetryBudget and is meant to be
+// shared by every Retry RoundTripper calling the same upstream. It is safe
+// for concurrent use.
+type RetryBudget struct {
+	ratio   float64
+	reserve float64
+	width   time.Duration
+	clock   Clock
+
+	buckets [budgetBuckets]budgetBucket
+	mutex   sync.Mutex
+}
+
+// NewRetryBudget returns a new RetryBudget that allows, within any window,
+// ratio retries per successful request plus minPerSecond retries per second
+// of the window. For example, a ratio of 0.1 allows at most one retry per ten
+// successes.
+//
+// If window is not positive, 10 seconds is used. If clock is nil, SystemClock
+// is used.
+func NewRetryBudget(ratio float64, minPerSecond uint, window time.Duration, clock Clock) *RetryBudget {
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
+	return &RetryBudget{
+		ratio:   max(ratio, 0),
+		reserve: float64(minPerSecond) * window.Seconds(),
+		width:   max(window/budgetBuckets, 1),
+		clock:   clock,
+	}
+}
+
+// bucket returns the bucket for epoch, resetting it if it is stale. The caller
+// must hold the mutex.
+func (budget *RetryBudget) bucket(epoch int64) *budgetBucket {
+	b := &budget.buckets[(epoch%budgetBuckets+budgetBuckets)%budgetBuckets]
+	if b.epoch != epoch {
+		*b = budgetBucket{epoch: epoch}
+	}
+	return b
+}
+
+// epoch returns the index of the window slice that now falls in.
+func (budget *RetryBudget) epoch() int64 {
+	return budget.clock.Now().UnixNano() / int64(budget.width)
+}
+
+// Deposit records a successful request.
+func (budget *RetryBudget) Deposit() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.bucket(budget.epoch()).deposits++
+}
+
+// Withdraw records and returns true if a retry is within budget. Otherwise,
+// it returns false and the retry should not be made.
+func (budget *RetryBudget) Withdraw() bool {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	epoch := budget.epoch()
+
+	var deposits, withdrawals float64
+	for _, b := range budget.buckets {
+		if b.epoch > epoch-budgetBuckets && b.epoch <= epoch {
+			deposits += b.deposits
+			withdrawals += b.withdrawals
+		}
+	}
+
+	if withdrawals+1 > budget.ratio*deposits+budget.reserve {
+		return false
+	}
+
+	budget.bucket(epoch).withdrawals++
+
+	return true
+}
+
+// RetryBudgetObserver is the interface implemented by a RetryObserver that
+// wants to know when a retry is denied by a RetryBudget. It is detected with
+// a type assertion, so existing observers need not implement it.
+type RetryBudgetObserver interface {
+	OnRetryDenied(*http.Request, uint)
+}
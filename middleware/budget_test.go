@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+func TestRetryBudget_Withdraw(t *testing.T) {
+	tests := []struct {
+		name         string
+		ratio        float64
+		minPerSecond uint
+		deposits     int
+		want         int
+	}{
+		{name: "must_deny_on_empty_budget", want: 0},
+		{name: "must_allow_min_per_second_over_window", minPerSecond: 1, want: 10},
+		{name: "must_allow_ratio_of_deposits", ratio: 0.2, deposits: 50, want: 10},
+		{name: "must_allow_ratio_plus_reserve", ratio: 0.5, minPerSecond: 1, deposits: 4, want: 12},
+		{name: "must_clamp_negative_ratio", ratio: -1, deposits: 10, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			budget := NewRetryBudget(tt.ratio, tt.minPerSecond, 10*time.Second, clock)
+			for range tt.deposits {
+				budget.Deposit()
+			}
+
+			got := 0
+			for budget.Withdraw() {
+				got++
+			}
+			if got != tt.want {
+				t.Errorf("got %v withdrawals, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBudget_Window(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	budget := NewRetryBudget(1, 0, 10*time.Second, clock)
+
+	budget.Deposit()
+	clock.Advance(9 * time.Second)
+	if !budget.Withdraw() {
+		t.Fatalf("got denied within window, want allowed")
+	}
+	if budget.Withdraw() {
+		t.Fatalf("got allowed past deposits, want denied")
+	}
+
+	// the deposit leaves the window before the withdrawal does
+	clock.Advance(time.Second)
+	budget.Deposit()
+	if budget.Withdraw() {
+		t.Errorf("got allowed with withdrawal still in window, want denied")
+	}
+
+	clock.Advance(9 * time.Second)
+	if !budget.Withdraw() {
+		t.Errorf("got denied after withdrawal left window, want allowed")
+	}
+}
+
+func TestNewRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0, 1, 0, nil)
+
+	if budget.width != time.Second {
+		t.Errorf("got bucket width %v, want %v", budget.width, time.Second)
+	}
+	if _, ok := budget.clock.(SystemClock); !ok {
+		t.Errorf("got clock %T, want SystemClock", budget.clock)
+	}
+}
+
+// deniedObserver records denied retries.
+type deniedObserver struct {
+	NopRetryObserver
+	denied []uint
+}
+
+func (o *deniedObserver) OnRetryDenied(_ *http.Request, i uint) { o.denied = append(o.denied, i) }
+
+func TestRetry_Budget(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	budget := NewRetryBudget(0.5, 0, 10*time.Second, clock)
+
+	status := http.StatusOK
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Body: http.NoBody, Request: r}, nil
+	})
+
+	observer := &deniedObserver{}
+	policy := RetryPolicy{MaxAttempts: 5, Backoff: ConstantBackoff(0)}
+	retry := Retry(policy, WithRetryBudget(budget), WithRetryObserver(observer), WithRetryClock(clock))(tripper)
+
+	// two successes deposit enough for one retry
+	for range 2 {
+		retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	status = http.StatusServiceUnavailable
+	resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("RoundTripper failed %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if len(observer.denied) != 1 || observer.denied[0] != 2 {
+		t.Errorf("got denied tries %v, want [2]", observer.denied)
+	}
+}
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// BulkheadError is returned by a Bulkhead RoundTripper when a request is
+// rejected because both the in-flight limit and the wait queue for its key
+// are full.
+type BulkheadError struct {
+	Key   string
+	Limit uint
+	Queue uint
+}
+
+func (e *BulkheadError) Error() string {
+	return fmt.Sprintf("bulkhead full: %q has %d in flight and %d queued", e.Key, e.Limit, e.Queue)
+}
+
+// HostKey returns r.URL.Host. It is used if no key function is supplied in
+// Bulkhead.
+func HostKey(r *http.Request) string { return r.URL.Host }
+
+// compartment tracks the in-flight slots and queued waiters of a single key.
+type compartment struct {
+	slots  chan struct{}
+	queued uint
+	users  uint // holders plus waiters; the compartment is dropped at zero
+}
+
+// bulkhead holds the compartments of a Bulkhead RoundTripper.
+type bulkhead struct {
+	limit        uint
+	queue        uint
+	compartments map[string]*compartment
+	mutex        sync.Mutex
+}
+
+// acquire takes a slot in the compartment for key, waiting in its queue if
+// all slots are taken. It returns a *BulkheadError if the queue is full and
+// the context error if r's context is done while waiting.
+func (b *bulkhead) acquire(r *http.Request, key string) (*compartment, error) {
+	b.mutex.Lock()
+	c, ok := b.compartments[key]
+	if !ok {
+		c = &compartment{slots: make(chan struct{}, b.limit)}
+		b.compartments[key] = c
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		c.users++
+		b.mutex.Unlock()
+		return c, nil
+	default:
+	}
+
+	if c.queued >= b.queue {
+		b.mutex.Unlock()
+		return nil, &BulkheadError{Key: key, Limit: b.limit, Queue: b.queue}
+	}
+	c.queued++
+	c.users++
+	b.mutex.Unlock()
+
+	select {
+	case c.slots <- struct{}{}:
+		b.mutex.Lock()
+		c.queued--
+		b.mutex.Unlock()
+		return c, nil
+	case <-r.Context().Done():
+		b.mutex.Lock()
+		c.queued--
+		b.leave(key, c)
+		b.mutex.Unlock()
+		return nil, r.Context().Err()
+	}
+}
+
+// release frees the slot taken in c.
+func (b *bulkhead) release(key string, c *compartment) {
+	<-c.slots
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.leave(key, c)
+}
+
+// leave drops a user of c, deleting c once unused. The caller must hold the
+// mutex.
+func (b *bulkhead) leave(key string, c *compartment) {
+	c.users--
+	if c.users == 0 {
+		delete(b.compartments, key)
+	}
+}
+
+// releaseBody wraps a response body and releases its bulkhead slot once, on
+// Close.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Bulkhead returns middleware that caps concurrent round trips per key. At
+// most limit requests sharing a key are in flight at once; up to queue more
+// wait for a slot, or until their context is done. Further requests are
+// rejected with a *BulkheadError. A slot is held until the response body is
+// closed, or until the round trip returns an error.
+//
+// Placed outside RetryAndObserve, a slot is held across all tries of a
+// request; placed inside, each try takes its own slot.
+//
+// If key is nil, HostKey is used. Bulkhead panics if limit is 0.
+func Bulkhead(limit uint, queue uint, key func(*http.Request) string) func(http.RoundTripper) http.RoundTripper {
+	if limit == 0 {
+		panic("middleware: Bulkhead limit must be positive")
+	}
+	if key == nil {
+		key = HostKey
+	}
+
+	b := &bulkhead{limit: limit, queue: queue, compartments: map[string]*compartment{}}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			k := key(r)
+			c, err := b.acquire(r, k)
+			if err != nil {
+				return nil, err
+			}
+
+			release := func() { b.release(k, c) }
+
+			resp, err := next.RoundTrip(r)
+			if err != nil || resp == nil || resp.Body == nil {
+				release()
+				return resp, err
+			}
+
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+
+			return resp, nil
+		})
+	}
+}
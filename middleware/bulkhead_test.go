@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingTripper returns a RoundTripper that signals on started and then
+// blocks until unblock is closed.
+func blockingTripper(started chan<- string, unblock <-chan struct{}) http.RoundTripper {
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		started <- r.URL.Host
+		<-unblock
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+}
+
+func TestBulkhead(t *testing.T) {
+	started := make(chan string)
+	unblock := make(chan struct{})
+	tripper := Bulkhead(1, 1, nil)(blockingTripper(started, unblock))
+
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			resp, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "http://a.example/", nil))
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+	}
+
+	// one request is in flight, the other must be queued
+	<-started
+	select {
+	case <-started:
+		t.Fatalf("got second request in flight, want it queued")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// in flight and queue are full for a.example
+	_, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "http://a.example/", nil))
+	var bulkheadErr *BulkheadError
+	if !errors.As(err, &bulkheadErr) {
+		t.Fatalf("got error %v, want *BulkheadError", err)
+	}
+	if bulkheadErr.Key != "a.example" {
+		t.Errorf("got key '%v', want 'a.example'", bulkheadErr.Key)
+	}
+
+	// other keys are isolated
+	go func() {
+		resp, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "http://b.example/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	if got := <-started; got != "b.example" {
+		t.Errorf("got started '%v', want 'b.example'", got)
+	}
+
+	// releasing lets the queued request through
+	close(unblock)
+	<-started
+	for range 3 {
+		if err := <-done; err != nil {
+			t.Errorf("got error %v, want nil", err)
+		}
+	}
+}
+
+func TestBulkhead_ReleaseOnBodyClose(t *testing.T) {
+	tripper := Bulkhead(1, 0, nil)(RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	}))
+
+	resp, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("RoundTripper failed %s", err.Error())
+	}
+
+	// the slot is held until the body is closed
+	var bulkheadErr *BulkheadError
+	if _, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.As(err, &bulkheadErr) {
+		t.Errorf("got error %v, want *BulkheadError", err)
+	}
+
+	resp.Body.Close()
+	resp.Body.Close() // must release only once
+
+	if _, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
+
+func TestBulkhead_ReleaseOnError(t *testing.T) {
+	tripper := Bulkhead(1, 0, nil)(RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("simulated network error")
+	}))
+
+	for range 2 {
+		var bulkheadErr *BulkheadError
+		if _, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil)); errors.As(err, &bulkheadErr) {
+			t.Errorf("got *BulkheadError, want slot released after error")
+		}
+	}
+}
+
+func TestBulkhead_ContextDoneWhileQueued(t *testing.T) {
+	started := make(chan string)
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	tripper := Bulkhead(1, 1, func(*http.Request) string { return "key" })(blockingTripper(started, unblock))
+
+	go tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := tripper.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBulkhead_DropUnusedCompartments(t *testing.T) {
+	b := &bulkhead{limit: 1, queue: 1, compartments: map[string]*compartment{}}
+
+	c, err := b.acquire(httptest.NewRequest(http.MethodGet, "/", nil), "key")
+	if err != nil {
+		t.Fatalf("failed to acquire: %s", err.Error())
+	}
+	b.release("key", c)
+	if got := len(b.compartments); got != 0 {
+		t.Errorf("got %v compartments, want 0", got)
+	}
+}
+
+func TestBulkhead_PanicOnZeroLimit(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("did not panic as expected")
+		}
+	}()
+
+	Bulkhead(0, 1, nil)
+}
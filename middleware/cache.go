@@ -0,0 +1,695 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore is the interface implemented by storage for Cache. Stores need
+// not be durable: a failed Set may drop the value and a failed Get reports a
+// miss. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+// LRUCacheStore is an in-memory CacheStore that evicts the least recently used
+// values once their total size exceeds a limit. It is safe for concurrent
+// use.
+type LRUCacheStore struct {
+	limit int64
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+	mutex sync.Mutex
+}
+
+// lruItem is a value held by an LRUCacheStore.
+type lruItem struct {
+	key   string
+	value []byte
+}
+
+// NewLRUCacheStore returns a new LRUCacheStore holding at most limit bytes of
+// values. Values larger than limit are not stored.
+func NewLRUCacheStore(limit int64) *LRUCacheStore {
+	return &LRUCacheStore{limit: limit, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (s *LRUCacheStore) Get(key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (s *LRUCacheStore) Set(key string, value []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(key)
+	if int64(len(value)) > s.limit {
+		return
+	}
+
+	s.items[key] = s.order.PushFront(&lruItem{key: key, value: value})
+	s.size += int64(len(value))
+
+	for s.size > s.limit {
+		s.remove(s.order.Back().Value.(*lruItem).key)
+	}
+}
+
+func (s *LRUCacheStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(key)
+}
+
+// remove deletes the value under key, if any. The caller must hold the mutex.
+func (s *LRUCacheStore) remove(key string) {
+	if e, ok := s.items[key]; ok {
+		s.order.Remove(e)
+		delete(s.items, key)
+		s.size -= int64(len(e.Value.(*lruItem).value))
+	}
+}
+
+// FileCacheStore is a CacheStore that keeps each value in a file of a
+// directory, named by the SHA-256 hash of its key, so that cached responses
+// survive restarts. It never evicts values: the directory grows with every
+// key stored and not deleted, so it suits a bounded set of URLs. It is safe
+// for concurrent use.
+type FileCacheStore struct {
+	dir string
+}
+
+// NewFileCacheStore returns a new FileCacheStore in dir, which is created on
+// the first Set if it does not exist.
+func NewFileCacheStore(dir string) *FileCacheStore { return &FileCacheStore{dir: dir} }
+
+// path returns the path of the file holding the value under key.
+func (s *FileCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *FileCacheStore) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(s.path(key))
+	return data, err == nil
+}
+
+func (s *FileCacheStore) Set(key string, value []byte) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return
+	}
+	writeFileAtomic(s.path(key), value)
+}
+
+func (s *FileCacheStore) Delete(key string) { os.Remove(s.path(key)) }
+
+// CacheStatus describes how a Cache answered a request.
+type CacheStatus string
+
+const (
+	CacheStatusHit         CacheStatus = "hit"
+	CacheStatusMiss        CacheStatus = "miss"
+	CacheStatusRevalidated CacheStatus = "revalidated"
+	CacheStatusStale       CacheStatus = "stale"
+	CacheStatusBypass      CacheStatus = "bypass"
+)
+
+// cacheStatusKey is the context key under which Cache stores a CacheStatus.
+type cacheStatusKey struct{}
+
+// CacheStatusFromContext returns the CacheStatus of the round trip whose
+// request has context ctx, and whether Cache answered it. It is typically
+// called with the context of a response's Request.
+func CacheStatusFromContext(ctx context.Context) (CacheStatus, bool) {
+	status, ok := ctx.Value(cacheStatusKey{}).(CacheStatus)
+	return status, ok
+}
+
+// cacheOptions holds the optional configuration of a Cache RoundTripper.
+type cacheOptions struct {
+	clock   Clock
+	private bool
+}
+
+// CacheOption is a function that sets a Cache option.
+type CacheOption func(*cacheOptions)
+
+// WithCacheClock sets Cache to tell time using clock.
+func WithCacheClock(clock Clock) CacheOption {
+	return func(o *cacheOptions) { o.clock = clock }
+}
+
+// WithCachePrivate sets Cache to act as a private cache, which serves a single
+// user: it stores responses marked private and responses to requests with
+// Authorization, and ignores s-maxage.
+func WithCachePrivate() CacheOption {
+	return func(o *cacheOptions) { o.private = true }
+}
+
+// heuristicStatus holds the response statuses that may be cached without
+// explicit freshness, as listed in RFC 9110.
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Cache returns middleware that caches responses to GET requests in store
+// following RFC 9111. It honors the Cache-Control directives max-age,
+// s-maxage, no-store, no-cache, private, public, must-revalidate,
+// stale-while-revalidate and stale-if-error, the Expires and Vary header
+// fields, and revalidates stale responses with ETag and Last-Modified. A
+// response with a Vary header field is stored once per combination of the
+// request header values it selects. A successful request with an unsafe
+// method invalidates the cached responses for its URL.
+//
+// How Cache answered a request is retrievable with CacheStatusFromContext
+// from the context of the response's Request, and is logged by a
+// RequestLogger placed outside Cache.
+//
+// By default, Cache acts as a shared cache and uses SystemClock.
+func Cache(store CacheStore, opts ...CacheOption) func(http.RoundTripper) http.RoundTripper {
+	o := cacheOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		c := &cache{store: store, next: next, clock: o.clock, shared: !o.private, revalidating: map[string]bool{}}
+		return RoundTripperFunc(c.roundTrip)
+	}
+}
+
+// cache is the state of a Cache RoundTripper.
+type cache struct {
+	store  CacheStore
+	next   http.RoundTripper
+	clock  Clock
+	shared bool
+
+	revalidating map[string]bool
+	mutex        sync.Mutex
+
+	// guards the read-modify-write of vary indexes
+	varyMutex sync.Mutex
+}
+
+// varyIndex records the request header names that select the variants of
+// the responses for a URL, the generation the variants are stored under, and
+// their keys, so that they can be deleted with the index.
+type varyIndex struct {
+	Names      []string `json:"names"`
+	Generation string   `json:"generation"`
+	Variants   []string `json:"variants,omitempty"`
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	Status       int                 `json:"status"`
+	Header       http.Header         `json:"header"`
+	Body         []byte              `json:"body"`
+	RequestTime  time.Time           `json:"request_time"`
+	ResponseTime time.Time           `json:"response_time"`
+	Vary         map[string][]string `json:"vary,omitempty"`
+}
+
+func (c *cache) roundTrip(r *http.Request) (*http.Response, error) {
+	key := r.URL.String()
+	reqCC := parseCacheControl(r.Header)
+
+	if r.Method != http.MethodGet || reqCC.has("no-store") {
+		resp, err := c.next.RoundTrip(r)
+		if err == nil && !isSafeMethod(r.Method) && resp.StatusCode < http.StatusBadRequest {
+			c.invalidate(key)
+		}
+		return withCacheStatus(resp, r, CacheStatusBypass), err
+	}
+
+	entry := c.load(key, r)
+	if entry == nil {
+		return c.fetch(r, key, CacheStatusMiss)
+	}
+
+	now := c.clock.Now()
+	age := entry.age(now)
+	lifetime := entry.lifetime(c.shared)
+	respCC := parseCacheControl(entry.Header)
+
+	fresh := age < lifetime && !respCC.has("no-cache") && !reqCC.has("no-cache")
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+	if fresh {
+		return withCacheStatus(entry.response(r, age), r, CacheStatusHit), nil
+	}
+
+	// stale responses may only be served if the origin allows it
+	staleness := age - lifetime
+	mayServeStale := func(directive string) bool {
+		if respCC.has("must-revalidate") || respCC.has("no-cache") || reqCC.has("no-cache") ||
+			(c.shared && respCC.has("proxy-revalidate")) {
+			return false
+		}
+		window, ok := respCC.seconds(directive)
+		if !ok {
+			window, ok = reqCC.seconds(directive)
+		}
+		return ok && staleness <= window
+	}
+
+	if mayServeStale("stale-while-revalidate") {
+		resp := entry.response(r, age)
+		c.revalidateInBackground(r, key, entry)
+		return withCacheStatus(resp, r, CacheStatusStale), nil
+	}
+
+	resp, err := c.revalidate(r, key, entry)
+	if (err != nil || resp.StatusCode >= http.StatusInternalServerError) && mayServeStale("stale-if-error") {
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return withCacheStatus(entry.response(r, age), r, CacheStatusStale), nil
+	}
+
+	return resp, err
+}
+
+// load returns the entry stored for r under key, or under the key of the
+// variant the request header values of r select, or nil.
+func (c *cache) load(key string, r *http.Request) *cacheEntry {
+	var entry cacheEntry
+	if !c.get(key, &entry) {
+		var index varyIndex
+		if !c.get(varyIndexKey(key), &index) || !c.get(index.variantKey(key, r.Header), &entry) {
+			return nil
+		}
+	}
+
+	for name, values := range entry.Vary {
+		if strings.Join(r.Header.Values(name), ",") != strings.Join(values, ",") {
+			return nil
+		}
+	}
+
+	return &entry
+}
+
+// fetch makes the round trip for r and stores the response if it may be.
+func (c *cache) fetch(r *http.Request, key string, status CacheStatus) (*http.Response, error) {
+	requestTime := c.clock.Now()
+	resp, err := c.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+
+	return c.keep(r, key, resp, requestTime, status)
+}
+
+// keep stores resp to r, requested at requestTime, if it may be stored.
+func (c *cache) keep(r *http.Request, key string, resp *http.Response, requestTime time.Time, status CacheStatus) (*http.Response, error) {
+	if c.storable(r, resp) {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		c.save(key, r, &cacheEntry{
+			Status:       resp.StatusCode,
+			Header:       resp.Header.Clone(),
+			Body:         body,
+			RequestTime:  requestTime,
+			ResponseTime: c.clock.Now(),
+		})
+	}
+
+	return withCacheStatus(resp, r, status), nil
+}
+
+// revalidate makes a conditional round trip for r using the validators of
+// entry. If the origin answers 304 Not Modified, a refreshed copy of entry is
+// stored and served; otherwise the new response is, and replaces entry unless
+// it is a server error. entry is left unchanged.
+func (c *cache) revalidate(r *http.Request, key string, entry *cacheEntry) (*http.Response, error) {
+	req := r.Clone(r.Context())
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.Header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+
+	requestTime := c.clock.Now()
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return withCacheStatus(resp, r, CacheStatusMiss), nil
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		return c.keep(r, key, resp, requestTime, CacheStatusMiss)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	refreshed := *entry
+	refreshed.Header = entry.Header.Clone()
+	for name, values := range resp.Header {
+		if name != "Content-Length" {
+			refreshed.Header[name] = values
+		}
+	}
+	refreshed.RequestTime = requestTime
+	refreshed.ResponseTime = c.clock.Now()
+	c.save(key, r, &refreshed)
+
+	return withCacheStatus(refreshed.response(r, refreshed.age(refreshed.ResponseTime)), r, CacheStatusRevalidated), nil
+}
+
+// revalidateInBackground revalidates entry without blocking r, unless a
+// revalidation of key is already running.
+func (c *cache) revalidateInBackground(r *http.Request, key string, entry *cacheEntry) {
+	c.mutex.Lock()
+	if c.revalidating[key] {
+		c.mutex.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mutex.Unlock()
+
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.revalidating, key)
+			c.mutex.Unlock()
+		}()
+
+		resp, err := c.revalidate(req, key, entry)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+}
+
+// storable reports whether resp to r may be stored.
+func (c *cache) storable(r *http.Request, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if c.shared {
+		if cc.has("private") {
+			return false
+		}
+		if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+			return false
+		}
+	}
+
+	// without explicit freshness, a response is only worth storing if it can
+	// be revalidated once its heuristic freshness, if any, runs out
+	if cc.has("max-age") || (c.shared && cc.has("s-maxage")) || resp.Header.Get("Expires") != "" {
+		return true
+	}
+	validator := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	return (cc.has("public") || heuristicStatus[resp.StatusCode]) && validator
+}
+
+// save stores entry under key or, if it has a Vary header field, under the
+// key of the variant the request header values of r select, recording them.
+func (c *cache) save(key string, r *http.Request, entry *cacheEntry) {
+	c.varyMutex.Lock()
+	defer c.varyMutex.Unlock()
+
+	names := varyNames(entry.Header)
+	if len(names) == 0 {
+		entry.Vary = nil
+		c.dropVariants(key)
+		c.set(key, entry)
+		return
+	}
+
+	var index varyIndex
+	if !c.get(varyIndexKey(key), &index) || !slices.Equal(index.Names, names) {
+		c.dropVariants(key)
+		index = varyIndex{Names: names, Generation: rand.Text()}
+	}
+
+	entry.Vary = map[string][]string{}
+	for _, name := range names {
+		entry.Vary[name] = r.Header.Values(name)
+	}
+	variant := index.variantKey(key, r.Header)
+	if !slices.Contains(index.Variants, variant) {
+		index.Variants = append(index.Variants, variant)
+	}
+
+	c.set(varyIndexKey(key), index)
+	c.store.Delete(key)
+	c.set(variant, entry)
+}
+
+// invalidate deletes the entry stored under key and its variants, if any.
+func (c *cache) invalidate(key string) {
+	c.varyMutex.Lock()
+	defer c.varyMutex.Unlock()
+
+	c.store.Delete(key)
+	c.dropVariants(key)
+}
+
+// dropVariants deletes the varyIndex for the URL key and the variants it
+// lists. The caller must hold varyMutex.
+func (c *cache) dropVariants(key string) {
+	var index varyIndex
+	if c.get(varyIndexKey(key), &index) {
+		for _, variant := range index.Variants {
+			c.store.Delete(variant)
+		}
+	}
+	c.store.Delete(varyIndexKey(key))
+}
+
+// get decodes the value stored under key into v, and reports whether there
+// was one. A value that fails to decode is deleted.
+func (c *cache) get(key string, v any) bool {
+	data, ok := c.store.Get(key)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		c.store.Delete(key)
+		return false
+	}
+	return true
+}
+
+// set stores v under key.
+func (c *cache) set(key string, v any) {
+	if data, err := json.Marshal(v); err == nil {
+		c.store.Set(key, data)
+	}
+}
+
+// varyNames returns the sorted, canonical header names listed in the Vary
+// header field of h.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, field := range h.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// varyIndexKey returns the key of the varyIndex for the URL key.
+func varyIndexKey(key string) string { return key + "\nvary" }
+
+// variantKey returns the key of the variant for the URL key that the values
+// of h select.
+func (index varyIndex) variantKey(key string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key + "\n" + index.Generation)
+	for _, name := range index.Names {
+		b.WriteString("\n" + name + ": " + strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+// date returns the time the origin generated the entry's response.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// age returns the current age of the entry's response at now, as defined in
+// RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := max(e.ResponseTime.Sub(e.date()), 0)
+
+	var ageValue time.Duration
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = seconds(secs)
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	return max(apparent, corrected) + max(now.Sub(e.ResponseTime), 0)
+}
+
+// lifetime returns the freshness lifetime of the entry's response, as defined
+// in RFC 9111 section 4.2.1. Without explicit freshness, a heuristic of a
+// tenth of the time since Last-Modified, at most a day, is used.
+func (e *cacheEntry) lifetime(shared bool) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if shared {
+		if d, ok := cc.seconds("s-maxage"); ok {
+			return d
+		}
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0 // invalid dates mean already expired
+		}
+		return max(t.Sub(date), 0)
+	}
+
+	if modified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicStatus[e.Status] {
+		return min(max(date.Sub(modified), 0)/10, 24*time.Hour)
+	}
+
+	return 0
+}
+
+// response returns the entry as a response to r with age.
+func (e *cacheEntry) response(r *http.Request, age time.Duration) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       r,
+	}
+}
+
+// withCacheStatus records status in the context of the request of resp,
+// setting it to r if resp has none.
+func withCacheStatus(resp *http.Response, r *http.Request, status CacheStatus) *http.Response {
+	if resp == nil {
+		return nil
+	}
+	if resp.Request == nil {
+		resp.Request = r
+	}
+	resp.Request = resp.Request.WithContext(context.WithValue(resp.Request.Context(), cacheStatusKey{}, status))
+	return resp
+}
+
+// cacheControl holds the directives of Cache-Control header fields, by
+// lowercase name.
+type cacheControl map[string]string
+
+// parseCacheControl returns the Cache-Control directives of h.
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, field := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(field, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of directive as a duration, and whether it has a
+// valid one.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return seconds(secs), true
+}
+
+// isSafeMethod returns true if method is safe as defined in RFC 9110.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,585 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+// cacheOrigin is a fake origin server for Cache tests. respond is called with
+// the request and the number of the call, starting at 1.
+type cacheOrigin struct {
+	clock   *middlewaretest.Clock
+	respond func(r *http.Request, call int) (*http.Response, error)
+
+	calls int
+	mutex sync.Mutex
+}
+
+func (o *cacheOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.mutex.Lock()
+	o.calls++
+	call := o.calls
+	o.mutex.Unlock()
+
+	resp, err := o.respond(r, call)
+	if resp != nil {
+		resp.Header.Set("Date", o.clock.Now().Format(http.TimeFormat))
+		resp.Request = r
+	}
+	return resp, err
+}
+
+func (o *cacheOrigin) Calls() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.calls
+}
+
+// originResponse returns a response with status, Cache-Control cc, the
+// header fields in kv, and body.
+func originResponse(status int, cc string, body string, kv ...string) *http.Response {
+	h := http.Header{}
+	if cc != "" {
+		h.Set("Cache-Control", cc)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		h.Set(kv[i], kv[i+1])
+	}
+	return &http.Response{StatusCode: status, Header: h, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestCache(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	modified := start.Add(-100 * time.Minute).Format(http.TimeFormat)
+
+	type step struct {
+		advance    time.Duration
+		method     string
+		header     http.Header
+		wantStatus CacheStatus
+		wantCode   int
+		wantBody   string
+		wantCalls  int
+	}
+
+	tests := []struct {
+		name    string
+		opts    []CacheOption
+		respond func(r *http.Request, call int) (*http.Response, error)
+		steps   []step
+	}{
+		{
+			name: "must_hit_while_fresh",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", fmt.Sprintf("v%d", call)), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{advance: 30 * time.Second, wantStatus: CacheStatusHit, wantBody: "v1", wantCalls: 1},
+				{advance: 31 * time.Second, wantStatus: CacheStatusMiss, wantBody: "v2", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_not_store_no_store",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "no-store, max-age=60", "v"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{wantStatus: CacheStatusMiss, wantCalls: 2},
+			},
+		},
+		{
+			name: "must_revalidate_no_cache_with_etag",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if r.Header.Get("If-None-Match") == `"a"` {
+					return originResponse(http.StatusNotModified, "no-cache", ""), nil
+				}
+				return originResponse(http.StatusOK, "no-cache", "v1", "ETag", `"a"`), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{wantStatus: CacheStatusRevalidated, wantBody: "v1", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_revalidate_stale_with_last_modified",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if r.Header.Get("If-Modified-Since") == modified {
+					return originResponse(http.StatusNotModified, "max-age=10", ""), nil
+				}
+				return originResponse(http.StatusOK, "max-age=10", "v1", "Last-Modified", modified), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{advance: 20 * time.Second, wantStatus: CacheStatusRevalidated, wantBody: "v1", wantCalls: 2},
+				{advance: 5 * time.Second, wantStatus: CacheStatusHit, wantBody: "v1", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_use_heuristic_freshness_on_last_modified",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "", "v1", "Last-Modified", modified), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{advance: 9 * time.Minute, wantStatus: CacheStatusHit, wantCalls: 1},
+				{advance: 2 * time.Minute, wantStatus: CacheStatusMiss, wantCalls: 2},
+			},
+		},
+		{
+			name: "must_not_store_private_in_shared_cache",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "private, max-age=60", "v"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{wantStatus: CacheStatusMiss, wantCalls: 2},
+			},
+		},
+		{
+			name: "must_store_private_in_private_cache",
+			opts: []CacheOption{WithCachePrivate()},
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "private, max-age=60", "v"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{wantStatus: CacheStatusHit, wantCalls: 1},
+			},
+		},
+		{
+			name: "must_match_vary",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", r.Header.Get("Accept"), "Vary", "Accept"), nil
+			},
+			steps: []step{
+				{header: http.Header{"Accept": {"text/plain"}}, wantStatus: CacheStatusMiss, wantBody: "text/plain", wantCalls: 1},
+				{header: http.Header{"Accept": {"text/plain"}}, wantStatus: CacheStatusHit, wantBody: "text/plain", wantCalls: 1},
+				{header: http.Header{"Accept": {"text/html"}}, wantStatus: CacheStatusMiss, wantBody: "text/html", wantCalls: 2},
+				{header: http.Header{"Accept": {"text/plain"}}, wantStatus: CacheStatusHit, wantBody: "text/plain", wantCalls: 2},
+				{header: http.Header{"Accept": {"text/html"}}, wantStatus: CacheStatusHit, wantBody: "text/html", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_invalidate_variants_on_unsafe_method",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", fmt.Sprintf("v%d", call), "Vary", "Accept"), nil
+			},
+			steps: []step{
+				{header: http.Header{"Accept": {"text/plain"}}, wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{header: http.Header{"Accept": {"text/html"}}, wantStatus: CacheStatusMiss, wantBody: "v2", wantCalls: 2},
+				{method: http.MethodPost, wantStatus: CacheStatusBypass, wantCalls: 3},
+				{header: http.Header{"Accept": {"text/plain"}}, wantStatus: CacheStatusMiss, wantBody: "v4", wantCalls: 4},
+				{header: http.Header{"Accept": {"text/html"}}, wantStatus: CacheStatusMiss, wantBody: "v5", wantCalls: 5},
+			},
+		},
+		{
+			name: "must_serve_stale_on_error_status",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if call > 1 {
+					return originResponse(http.StatusServiceUnavailable, "", "down"), nil
+				}
+				return originResponse(http.StatusOK, "max-age=10, stale-if-error=60", "v1"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{advance: 20 * time.Second, wantStatus: CacheStatusStale, wantBody: "v1", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_keep_entry_on_fresh_error_status",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if call > 1 {
+					return originResponse(http.StatusServiceUnavailable, "max-age=60", "down"), nil
+				}
+				return originResponse(http.StatusOK, "max-age=10, stale-if-error=60", "v1"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{advance: 20 * time.Second, wantStatus: CacheStatusStale, wantBody: "v1", wantCalls: 2},
+				{advance: 5 * time.Second, wantStatus: CacheStatusStale, wantBody: "v1", wantCalls: 3},
+			},
+		},
+		{
+			name: "must_serve_stale_on_transport_error",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if call > 1 {
+					return nil, fmt.Errorf("simulated network error")
+				}
+				return originResponse(http.StatusOK, "max-age=10, stale-if-error=60", "v1"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{advance: 20 * time.Second, wantStatus: CacheStatusStale, wantBody: "v1", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_not_serve_stale_past_stale_if_error",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if call > 1 {
+					return originResponse(http.StatusServiceUnavailable, "", "down"), nil
+				}
+				return originResponse(http.StatusOK, "max-age=10, stale-if-error=60", "v1"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{advance: 2 * time.Minute, wantStatus: CacheStatusMiss, wantCode: http.StatusServiceUnavailable, wantBody: "down", wantCalls: 2},
+			},
+		},
+		{
+			name: "must_not_serve_stale_on_must_revalidate",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				if call > 1 {
+					return originResponse(http.StatusServiceUnavailable, "", "down"), nil
+				}
+				return originResponse(http.StatusOK, "max-age=10, must-revalidate, stale-if-error=60", "v1"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{advance: 20 * time.Second, wantStatus: CacheStatusMiss, wantCode: http.StatusServiceUnavailable, wantCalls: 2},
+			},
+		},
+		{
+			name: "must_invalidate_on_unsafe_method",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", fmt.Sprintf("v%d", call)), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantBody: "v1", wantCalls: 1},
+				{method: http.MethodPost, wantStatus: CacheStatusBypass, wantCalls: 2},
+				{wantStatus: CacheStatusMiss, wantBody: "v3", wantCalls: 3},
+			},
+		},
+		{
+			name: "must_bypass_on_no_store_request",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", "v"), nil
+			},
+			steps: []step{
+				{header: http.Header{"Cache-Control": {"no-store"}}, wantStatus: CacheStatusBypass, wantCalls: 1},
+				{wantStatus: CacheStatusMiss, wantCalls: 2},
+			},
+		},
+		{
+			name: "must_revalidate_on_request_max_age",
+			respond: func(r *http.Request, call int) (*http.Response, error) {
+				return originResponse(http.StatusOK, "max-age=60", "v"), nil
+			},
+			steps: []step{
+				{wantStatus: CacheStatusMiss, wantCalls: 1},
+				{advance: 20 * time.Second, header: http.Header{"Cache-Control": {"max-age=10"}}, wantStatus: CacheStatusMiss, wantCalls: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(start)
+			origin := &cacheOrigin{clock: clock, respond: tt.respond}
+			transport := Cache(NewLRUCacheStore(1<<20), append([]CacheOption{WithCacheClock(clock)}, tt.opts...)...)(origin)
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+
+				method := s.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				r := httptest.NewRequest(method, "http://example.com/data", nil)
+				for name, values := range s.header {
+					r.Header[name] = values
+				}
+
+				resp, err := transport.RoundTrip(r)
+				if err != nil {
+					t.Fatalf("step %d: got error %v, want nil", i, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if got, _ := CacheStatusFromContext(resp.Request.Context()); got != s.wantStatus {
+					t.Errorf("step %d: got cache status %v, want %v", i, got, s.wantStatus)
+				}
+				wantCode := s.wantCode
+				if wantCode == 0 {
+					wantCode = http.StatusOK
+				}
+				if resp.StatusCode != wantCode {
+					t.Errorf("step %d: got status %v, want %v", i, resp.StatusCode, wantCode)
+				}
+				if s.wantBody != "" && string(body) != s.wantBody {
+					t.Errorf("step %d: got body '%s', want '%s'", i, body, s.wantBody)
+				}
+				if got := origin.Calls(); got != s.wantCalls {
+					t.Errorf("step %d: got origin calls %v, want %v", i, got, s.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_Storable(t *testing.T) {
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+
+	tests := []struct {
+		name string
+		resp *http.Response
+		want bool
+	}{
+		{name: "must_store_max_age", resp: originResponse(http.StatusOK, "max-age=60", "v"), want: true},
+		{name: "must_store_expires", resp: originResponse(http.StatusOK, "", "v", "Expires", modified), want: true},
+		{name: "must_store_heuristic_with_etag", resp: originResponse(http.StatusOK, "", "v", "ETag", `"a"`), want: true},
+		{name: "must_store_public_with_last_modified", resp: originResponse(http.StatusCreated, "public", "v", "Last-Modified", modified), want: true},
+		{name: "must_not_store_heuristic_without_validator", resp: originResponse(http.StatusOK, "", "v"), want: false},
+		{name: "must_not_store_public_without_validator", resp: originResponse(http.StatusOK, "public", "v"), want: false},
+		{name: "must_not_store_non_heuristic_status", resp: originResponse(http.StatusCreated, "", "v", "ETag", `"a"`), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewLRUCacheStore(1 << 20)
+			origin := RoundTripperFunc(func(r *http.Request) (*http.Response, error) { return tt.resp, nil })
+
+			resp, err := Cache(store)(origin).RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/data", nil))
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			resp.Body.Close()
+
+			if _, got := store.Get("http://example.com/data"); got != tt.want {
+				t.Errorf("got stored %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	origin := &cacheOrigin{clock: clock, respond: func(r *http.Request, call int) (*http.Response, error) {
+		return originResponse(http.StatusOK, "max-age=10, stale-while-revalidate=60", fmt.Sprintf("v%d", call)), nil
+	}}
+	transport := Cache(NewLRUCacheStore(1<<20), WithCacheClock(clock))(origin)
+
+	get := func() (string, CacheStatus) {
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/data", nil))
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		status, _ := CacheStatusFromContext(resp.Request.Context())
+		return string(body), status
+	}
+
+	get()
+	clock.Advance(20 * time.Second)
+	if body, status := get(); body != "v1" || status != CacheStatusStale {
+		t.Errorf("got body '%v' and status %v, want 'v1' and %v", body, status, CacheStatusStale)
+	}
+
+	// the revalidation happens in the background
+	for deadline := time.Now().Add(time.Second); origin.Calls() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v origin calls, want background revalidation", origin.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var body string
+	var status CacheStatus
+	for deadline := time.Now().Add(time.Second); body != "v2"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got body '%v' and status %v, want revalidated 'v2'", body, status)
+		}
+		body, status = get()
+		time.Sleep(time.Millisecond)
+	}
+	if status != CacheStatusHit {
+		t.Errorf("got status %v, want %v", status, CacheStatusHit)
+	}
+}
+
+func TestCache_StaleWhileRevalidate_NotModified(t *testing.T) {
+	// the origin shares no locks with the caller, so that the race detector
+	// sees the stale response and the revalidation as concurrent
+	var calls atomic.Int32
+	revalidating := make(chan struct{})
+	origin := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if n := calls.Add(1); n > 1 {
+			if n == 2 {
+				close(revalidating)
+			}
+			return originResponse(http.StatusNotModified, "max-age=10, stale-while-revalidate=60", "", "X-Revalidated", "1"), nil
+		}
+		return originResponse(http.StatusOK, "max-age=10, stale-while-revalidate=60", "v1", "ETag", `"v1"`), nil
+	})
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	transport := Cache(NewLRUCacheStore(1<<20), WithCacheClock(clock))(origin)
+
+	get := func() *http.Response {
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/data", nil))
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	get()
+	clock.Advance(20 * time.Second)
+	if resp := get(); resp.Header.Get("X-Revalidated") != "" || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("got header %v, want the stale one", resp.Header)
+	}
+	<-revalidating
+
+	for deadline := time.Now().Add(time.Second); get().Header.Get("X-Revalidated") == ""; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got no refreshed response, want background revalidation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCache_VaryCleanup(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	vary := "Accept"
+	origin := &cacheOrigin{clock: clock, respond: func(r *http.Request, call int) (*http.Response, error) {
+		return originResponse(http.StatusOK, "max-age=60", "v", "Vary", vary), nil
+	}}
+	store := NewLRUCacheStore(1 << 20)
+	transport := Cache(store, WithCacheClock(clock))(origin)
+
+	send := func(method string, accept string) {
+		r := httptest.NewRequest(method, "http://example.com/data", nil)
+		r.Header.Set("Accept", accept)
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	stored := func() int {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return len(store.items)
+	}
+
+	// the index and one value per variant
+	send(http.MethodGet, "text/plain")
+	send(http.MethodGet, "text/html")
+	if got := stored(); got != 3 {
+		t.Errorf("got %v stored values, want 3", got)
+	}
+
+	// invalidation deletes the variants with the index
+	send(http.MethodPost, "")
+	if got := stored(); got != 0 {
+		t.Errorf("got %v stored values after invalidation, want 0", got)
+	}
+
+	// a new generation deletes the variants of the previous one
+	send(http.MethodGet, "text/plain")
+	send(http.MethodGet, "text/html")
+	vary = "Accept-Language"
+	clock.Advance(time.Minute)
+	send(http.MethodGet, "text/plain")
+	if got := stored(); got != 2 {
+		t.Errorf("got %v stored values after new generation, want 2", got)
+	}
+
+	// a response without Vary deletes the index and its variants
+	vary = ""
+	clock.Advance(time.Minute)
+	send(http.MethodGet, "text/plain")
+	if got := stored(); got != 1 {
+		t.Errorf("got %v stored values without Vary, want 1", got)
+	}
+}
+
+func TestCache_RequestLogger(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	origin := &cacheOrigin{clock: clock, respond: func(r *http.Request, call int) (*http.Response, error) {
+		return originResponse(http.StatusOK, "max-age=60", "v"), nil
+	}}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	transport := RequestLogger(logger, "")(Cache(NewLRUCacheStore(1<<20), WithCacheClock(clock))(origin))
+
+	for _, want := range []string{"cache=miss", "cache=hit"} {
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		resp.Body.Close()
+
+		if got := buf.String(); !strings.Contains(got, want) {
+			t.Errorf("'%s' does not contain '%s'", got, want)
+		}
+		buf.Reset()
+	}
+}
+
+func TestCacheStores(t *testing.T) {
+	tests := []struct {
+		name  string
+		store CacheStore
+	}{
+		{name: "must_store_in_lru", store: NewLRUCacheStore(1 << 10)},
+		{name: "must_store_in_files", store: NewFileCacheStore(t.TempDir() + "/cache")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := tt.store.Get("a"); ok {
+				t.Errorf("got value for missing key, want none")
+			}
+			tt.store.Set("a", []byte("1"))
+			tt.store.Set("a", []byte("2"))
+			if got, ok := tt.store.Get("a"); !ok || string(got) != "2" {
+				t.Errorf("got value '%s' and %v, want '2' and true", got, ok)
+			}
+			tt.store.Delete("a")
+			if _, ok := tt.store.Get("a"); ok {
+				t.Errorf("got value after delete, want none")
+			}
+		})
+	}
+}
+
+func TestLRUCacheStore_Evict(t *testing.T) {
+	store := NewLRUCacheStore(4)
+	store.Set("a", []byte("11"))
+	store.Set("b", []byte("22"))
+	store.Get("a") // b is now least recently used
+	store.Set("c", []byte("33"))
+
+	if _, ok := store.Get("b"); ok {
+		t.Errorf("got b, want evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Errorf("got %v evicted, want kept", key)
+		}
+	}
+
+	store.Set("d", []byte("too large"))
+	if _, ok := store.Get("d"); ok {
+		t.Errorf("got value over limit, want none")
+	}
+}
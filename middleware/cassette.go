@@ -0,0 +1,321 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// CassetteMode selects what a Cassette does with round trips.
+type CassetteMode int
+
+const (
+	// CassetteReplay serves responses from the cassette and fails requests
+	// that match none of its interactions.
+	CassetteReplay CassetteMode = iota
+	// CassetteRecord makes real round trips and records them to the cassette.
+	CassetteRecord
+	// CassettePassthrough makes real round trips and records nothing.
+	CassettePassthrough
+)
+
+// CassetteMatch is a set of request properties a Cassette compares to find the
+// recorded interaction for a request.
+type CassetteMatch int
+
+// Request properties a Cassette can match on. Header fields are matched with
+// WithCassetteMatchHeaders.
+const (
+	MatchMethod CassetteMatch = 1 << iota
+	MatchURL
+	MatchBody
+)
+
+// ErrCassetteMiss is returned by a replaying Cassette for a request that
+// matches none of its interactions.
+var ErrCassetteMiss = errors.New("no cassette interaction matches request")
+
+// cassetteBody is a recorded body. Bodies that are not valid UTF-8 are
+// base64 encoded.
+type cassetteBody struct {
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newCassetteBody(data []byte) cassetteBody {
+	if utf8.Valid(data) {
+		return cassetteBody{Text: string(data)}
+	}
+	return cassetteBody{Text: base64.StdEncoding.EncodeToString(data), Encoding: "base64"}
+}
+
+func (b cassetteBody) bytes() []byte {
+	if b.Encoding == "base64" {
+		data, _ := base64.StdEncoding.DecodeString(b.Text)
+		return data
+	}
+	return []byte(b.Text)
+}
+
+type cassetteRequest struct {
+	Method string       `json:"method"`
+	URL    string       `json:"url"`
+	Header http.Header  `json:"header"`
+	Body   cassetteBody `json:"body"`
+}
+
+type cassetteResponse struct {
+	Status int          `json:"status"`
+	Header http.Header  `json:"header"`
+	Body   cassetteBody `json:"body"`
+}
+
+type cassetteInteraction struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+// cassetteOptions holds the optional configuration of a Cassette.
+type cassetteOptions struct {
+	match        CassetteMatch
+	matchHeaders []string
+	headers      []string
+	query        []string
+	fields       []string
+}
+
+// CassetteOption is a function that sets a Cassette option.
+type CassetteOption func(*cassetteOptions)
+
+// WithCassetteMatch sets Cassette to match requests on the properties in
+// match.
+func WithCassetteMatch(match CassetteMatch) CassetteOption {
+	return func(o *cassetteOptions) { o.match = match }
+}
+
+// WithCassetteMatchHeaders sets Cassette to also match requests on the values
+// of the header fields named in names. Redacted fields are recorded without
+// their values, so they should not be matched.
+func WithCassetteMatchHeaders(names ...string) CassetteOption {
+	return func(o *cassetteOptions) { o.matchHeaders = names }
+}
+
+// WithCassetteRedactHeaders sets Cassette to redact the values of the header
+// fields named in names before recording, replacing
+// DefaultDumpRedactHeaders.
+func WithCassetteRedactHeaders(names ...string) CassetteOption {
+	return func(o *cassetteOptions) { o.headers = names }
+}
+
+// WithCassetteRedactQuery sets Cassette to redact the values of the query
+// parameters named in names in recorded URLs, replacing DefaultRedactQuery.
+// Requests are matched on URL with the same parameters redacted.
+func WithCassetteRedactQuery(names ...string) CassetteOption {
+	return func(o *cassetteOptions) { o.query = names }
+}
+
+// WithCassetteRedactFields sets Cassette to redact the scalar values of the
+// JSON object fields named in names, at any depth, in bodies before
+// recording.
+func WithCassetteRedactFields(names ...string) CassetteOption {
+	return func(o *cassetteOptions) { o.fields = names }
+}
+
+// Cassette records round trips to a file and replays them, so that tests can
+// run against recorded traffic instead of hand-written fakes or live
+// servers. It is safe for concurrent use.
+type Cassette struct {
+	path         string
+	mode         CassetteMode
+	match        CassetteMatch
+	matchHeaders []string
+	headers      []string
+	query        []string
+	fields       *regexp.Regexp
+
+	interactions []cassetteInteraction
+	played       []bool
+	mutex        sync.Mutex
+}
+
+// NewCassette returns a new Cassette in mode for the file at path. A replaying
+// cassette loads its interactions from path and returns an error if it cannot.
+//
+// If no options are supplied, requests are matched on method and URL, and the
+// header fields in DefaultDumpRedactHeaders and query parameters in
+// DefaultRedactQuery are redacted.
+func NewCassette(path string, mode CassetteMode, opts ...CassetteOption) (*Cassette, error) {
+	o := cassetteOptions{match: MatchMethod | MatchURL, headers: DefaultDumpRedactHeaders, query: DefaultRedactQuery}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &Cassette{
+		path:         path,
+		mode:         mode,
+		match:        o.match,
+		matchHeaders: o.matchHeaders,
+		headers:      o.headers,
+		query:        o.query,
+		fields:       jsonFieldPattern(o.fields),
+	}
+
+	if mode == CassetteReplay {
+		data, err := os.ReadFile(path) // #nosec G304 -- path is supplied by the application
+		if err != nil {
+			return nil, err
+		}
+		var doc struct {
+			Interactions []cassetteInteraction `json:"interactions"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+		}
+		c.interactions = doc.Interactions
+		c.played = make([]bool, len(doc.Interactions))
+	}
+
+	return c, nil
+}
+
+// Transport is middleware that replays, records or passes through round trips
+// according to the cassette's mode. A replaying cassette never calls next,
+// which may then be nil. Each recorded interaction is replayed once, in
+// order of recording among those that match.
+func (c *Cassette) Transport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if c.mode == CassettePassthrough {
+			return next.RoundTrip(r)
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if c.mode == CassetteReplay {
+			return c.replay(r, body)
+		}
+
+		// RoundTrippers must not modify the request
+		req := r.Clone(r.Context())
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		c.interactions = append(c.interactions, cassetteInteraction{
+			Request: cassetteRequest{
+				Method: r.Method,
+				URL:    redactQuery(r.URL, c.query),
+				Header: redactHeader(r.Header, c.headers),
+				Body:   newCassetteBody(redactJSONFields(c.fields, body)),
+			},
+			Response: cassetteResponse{
+				Status: resp.StatusCode,
+				Header: redactHeader(resp.Header, c.headers),
+				Body:   newCassetteBody(redactJSONFields(c.fields, respBody)),
+			},
+		})
+
+		return resp, nil
+	})
+}
+
+// replay returns the response of the first unplayed interaction matching r
+// with body.
+func (c *Cassette) replay(r *http.Request, body []byte) (*http.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, in := range c.interactions {
+		if c.played[i] || !c.matches(in.Request, r, body) {
+			continue
+		}
+		c.played[i] = true
+
+		data := in.Response.Body.bytes()
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+			StatusCode:    in.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        in.Response.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+			Request:       r,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s %s", ErrCassetteMiss, r.Method, r.URL)
+}
+
+// matches reports whether the recorded request rec matches r with body.
+func (c *Cassette) matches(rec cassetteRequest, r *http.Request, body []byte) bool {
+	if c.match&MatchMethod != 0 && rec.Method != r.Method {
+		return false
+	}
+	if c.match&MatchURL != 0 && rec.URL != redactQuery(r.URL, c.query) {
+		return false
+	}
+	if c.match&MatchBody != 0 && !bytes.Equal(rec.Body.bytes(), redactJSONFields(c.fields, body)) {
+		return false
+	}
+	for _, name := range c.matchHeaders {
+		if rec.Header.Get(name) != r.Header.Get(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Save writes the recorded interactions to the cassette's file, replacing it.
+func (c *Cassette) Save() error {
+	c.mutex.Lock()
+	doc := struct {
+		Interactions []cassetteInteraction `json:"interactions"`
+	}{Interactions: c.interactions}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.path, data)
+}
+
+// Close saves a recording cassette. It does nothing in other modes.
+func (c *Cassette) Close() error {
+	if c.mode != CassetteRecord {
+		return nil
+	}
+	return c.Save()
+}
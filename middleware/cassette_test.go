@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		data, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"echo":` + string(data) + `,"token":"t0k3n"}`))
+	}))
+	defer server.Close()
+
+	do := func(transport http.RoundTripper, body string) (*http.Response, string, error) {
+		r, err := http.NewRequest(http.MethodPost, server.URL+"/items?api_key=k3y&page=1", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err.Error())
+		}
+		r.Header.Set("Authorization", "Bearer secret")
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			return nil, "", err
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data), nil
+	}
+
+	// record two interactions against the live server
+	opts := []CassetteOption{WithCassetteMatch(MatchMethod | MatchURL | MatchBody), WithCassetteRedactFields("token")}
+	rec, err := NewCassette(path, CassetteRecord, opts...)
+	if err != nil {
+		t.Fatalf("failed to create cassette: %s", err.Error())
+	}
+	for _, body := range []string{`"a"`, `"b"`} {
+		_, got, err := do(rec.Transport(http.DefaultTransport), body)
+		if err != nil {
+			t.Fatalf("got error %v, want nil", err)
+		}
+		if want := `{"echo":` + body + `,"token":"t0k3n"}`; got != want {
+			t.Errorf("got recorded body '%v', want '%v'", got, want)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err.Error())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read cassette: %s", err.Error())
+	}
+	for _, secret := range []string{"Bearer secret", "session=abc", "t0k3n", "k3y"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("got cassette containing '%v', want redacted", secret)
+		}
+	}
+
+	// replay without the server
+	play, err := NewCassette(path, CassetteReplay, opts...)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %s", err.Error())
+	}
+	transport := play.Transport(nil)
+
+	tests := []struct {
+		name     string
+		body     string
+		want     string
+		wantMiss bool
+	}{
+		{name: "must_replay_matching_body", body: `"b"`, want: `{"echo":"b","token":"[REDACTED]"}`},
+		{name: "must_replay_other_matching_body", body: `"a"`, want: `{"echo":"a","token":"[REDACTED]"}`},
+		{name: "must_miss_on_played_interaction", body: `"a"`, wantMiss: true},
+		{name: "must_miss_on_unknown_body", body: `"c"`, wantMiss: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, got, err := do(transport, tt.body)
+			if gotMiss := errors.Is(err, ErrCassetteMiss); gotMiss != tt.wantMiss {
+				t.Fatalf("got error %v, want miss %v", err, tt.wantMiss)
+			}
+			if tt.wantMiss {
+				return
+			}
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusCreated)
+			}
+			if got != tt.want {
+				t.Errorf("got body '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+
+	if calls != 2 {
+		t.Errorf("got %v server calls, want 2", calls)
+	}
+}
+
+func TestCassette_MatchHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	data := `{"interactions":[{"request":{"method":"GET","url":"http://example.com/","header":{"Accept":["text/plain"]}},"response":{"status":200,"body":{"text":"plain"}}}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write cassette: %s", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		accept   string
+		wantMiss bool
+	}{
+		{name: "must_replay_on_matching_header", accept: "text/plain"},
+		{name: "must_miss_on_other_header", accept: "application/json", wantMiss: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCassette(path, CassetteReplay, WithCassetteMatchHeaders("Accept"))
+			if err != nil {
+				t.Fatalf("failed to load cassette: %s", err.Error())
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.Header.Set("Accept", tt.accept)
+
+			_, err = c.Transport(nil).RoundTrip(r)
+			if gotMiss := errors.Is(err, ErrCassetteMiss); gotMiss != tt.wantMiss {
+				t.Errorf("got error %v, want miss %v", err, tt.wantMiss)
+			}
+		})
+	}
+}
+
+func TestCassette_Passthrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+
+	c, err := NewCassette(path, CassettePassthrough)
+	if err != nil {
+		t.Fatalf("failed to create cassette: %s", err.Error())
+	}
+	if _, err := c.Transport(tripper).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err.Error())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("got cassette file error %v, want not exist", err)
+	}
+}
+
+func TestNewCassette_Error(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0o600); err != nil {
+		t.Fatalf("failed to write cassette: %s", err.Error())
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing.json"), invalid} {
+		if _, err := NewCassette(path, CassetteReplay); err == nil {
+			t.Errorf("got nil error on %v, want error", path)
+		}
+	}
+}
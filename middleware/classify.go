@@ -0,0 +1,62 @@
+package middleware
+
+import "net/http"
+
+// Classifier is the interface implemented by an object that classifies the
+// outcome of a round trip. Retryable reports whether the outcome should be
+// retried. Failure reports whether the outcome counts against a
+// CircuitBreaker. Either resp or err may be nil.
+type Classifier interface {
+	Retryable(resp *http.Response, err error) bool
+	Failure(resp *http.Response, err error) bool
+}
+
+// DefaultClassifier retries and counts as a failure any 5xx response status
+// and 429 Too Many Requests. Errors are classified with ClassifyError: those
+// whose ErrorClass is retryable are retried, and those whose ErrorClass is a
+// failure count as one. It is used if no classifier is supplied to Retry.
+type DefaultClassifier struct{}
+
+func (DefaultClassifier) Retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return ClassifyError(err).Retryable()
+	}
+	return isFailure(resp, err)
+}
+
+func (DefaultClassifier) Failure(resp *http.Response, err error) bool {
+	if err != nil {
+		return ClassifyError(err).Failure()
+	}
+	return isFailure(resp, err)
+}
+
+// ClassifierFuncs implements Classifier using its fields. A nil field falls
+// back to the matching DefaultClassifier method.
+type ClassifierFuncs struct {
+	RetryableFunc func(resp *http.Response, err error) bool
+	FailureFunc   func(resp *http.Response, err error) bool
+}
+
+func (c ClassifierFuncs) Retryable(resp *http.Response, err error) bool {
+	if c.RetryableFunc == nil {
+		return DefaultClassifier{}.Retryable(resp, err)
+	}
+	return c.RetryableFunc(resp, err)
+}
+
+func (c ClassifierFuncs) Failure(resp *http.Response, err error) bool {
+	if c.FailureFunc == nil {
+		return DefaultClassifier{}.Failure(resp, err)
+	}
+	return c.FailureFunc(resp, err)
+}
+
+// isFailure returns true if err is not nil, or resp.StatusCode is 5xx or 429.
+func isFailure(resp *http.Response, err error) bool {
+	if err != nil || resp == nil {
+		return true
+	}
+
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestDefaultClassifier(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{name: "must_be_true_on_error", err: fmt.Errorf("simulated network error"), want: true},
+		{name: "must_be_true_on_connection_reset", err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, want: true},
+		{name: "must_be_false_on_canceled", err: fmt.Errorf("get: %w", context.Canceled), want: false},
+		{name: "must_be_false_on_invalid_url", err: fmt.Errorf("unsupported protocol scheme \"ftp\""), want: false},
+		{name: "must_be_true_on_nil_response", want: true},
+		{name: "must_be_true_on_status_500", resp: &http.Response{StatusCode: http.StatusInternalServerError}, want: true},
+		{name: "must_be_true_on_status_503", resp: &http.Response{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "must_be_true_on_status_429", resp: &http.Response{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "must_be_false_on_status_200", resp: &http.Response{StatusCode: http.StatusOK}, want: false},
+		{name: "must_be_false_on_status_400", resp: &http.Response{StatusCode: http.StatusBadRequest}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultClassifier{}
+			if got := c.Retryable(tt.resp, tt.err); got != tt.want {
+				t.Errorf("got retryable %v, want %v", got, tt.want)
+			}
+			if got := c.Failure(tt.resp, tt.err); got != tt.want {
+				t.Errorf("got failure %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifierFuncs(t *testing.T) {
+	never := func(*http.Response, error) bool { return false }
+
+	tests := []struct {
+		name          string
+		classifier    ClassifierFuncs
+		err           error
+		wantRetryable bool
+		wantFailure   bool
+	}{
+		{
+			name:          "must_fall_back_to_default_on_nil_funcs",
+			err:           syscall.ECONNRESET,
+			wantRetryable: true,
+			wantFailure:   true,
+		},
+		{
+			name:          "must_use_supplied_retryable_func",
+			classifier:    ClassifierFuncs{RetryableFunc: never},
+			err:           syscall.ECONNRESET,
+			wantRetryable: false,
+			wantFailure:   true,
+		},
+		{
+			name:          "must_use_supplied_failure_func",
+			classifier:    ClassifierFuncs{FailureFunc: never},
+			err:           syscall.ECONNRESET,
+			wantRetryable: true,
+			wantFailure:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.classifier.Retryable(nil, tt.err); got != tt.wantRetryable {
+				t.Errorf("got retryable %v, want %v", got, tt.wantRetryable)
+			}
+			if got := tt.classifier.Failure(nil, tt.err); got != tt.wantFailure {
+				t.Errorf("got failure %v, want %v", got, tt.wantFailure)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Clock is the interface implemented by an object that tells time and can
+// signal after a duration elapses. It is satisfied by the package-level
+// functions of package time through SystemClock.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// SystemClock implements Clock using package time. It is used if no clock is
+// supplied.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time                         { return time.Now() }
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// JitterSource is the interface implemented by an object that returns, as an
+// int64, a non-negative pseudo-random number in the half-open interval [0,n).
+// It panics if n <= 0. *rand.Rand from math/rand/v2 satisfies it, but is not
+// safe for concurrent use; see NewJitterSource.
+type JitterSource interface {
+	Int64N(n int64) int64
+}
+
+// globalJitter implements JitterSource using the math/rand/v2 top-level
+// functions. It is used if no jitter source is supplied.
+type globalJitter struct{}
+
+func (globalJitter) Int64N(n int64) int64 { return rand.Int64N(n) }
+
+// lockedJitter implements JitterSource by guarding a *rand.Rand with a mutex
+// so that it is safe for concurrent use.
+type lockedJitter struct {
+	rand  *rand.Rand
+	mutex sync.Mutex
+}
+
+func (j *lockedJitter) Int64N(n int64) int64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.rand.Int64N(n)
+}
+
+// NewJitterSource returns a JitterSource seeded with seed that is safe for
+// concurrent use. Sources with equal seeds return equal sequences.
+func NewJitterSource(seed uint64) JitterSource {
+	return &lockedJitter{rand: rand.New(rand.NewPCG(seed, seed))}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSystemClock(t *testing.T) {
+	clock := SystemClock{}
+
+	before := time.Now()
+	got := clock.Now()
+	if got.Before(before) || got.After(time.Now()) {
+		t.Errorf("got now %v, want time between %v and now", got, before)
+	}
+
+	select {
+	case <-clock.After(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Errorf("After did not fire")
+	}
+}
+
+func TestNewJitterSource(t *testing.T) {
+	a := NewJitterSource(42)
+	b := NewJitterSource(42)
+
+	for i := range 10 {
+		x, y := a.Int64N(1000), b.Int64N(1000)
+		if x != y {
+			t.Fatalf("draw %d: got %v and %v, want equal values for equal seeds", i, x, y)
+		}
+		if x < 0 || x >= 1000 {
+			t.Errorf("draw %d: got %v, want value in [0,1000)", i, x)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// flight is a round trip shared by concurrent identical requests.
+type flight struct {
+	done    chan struct{}
+	resp    *http.Response // without its body
+	body    []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// coalescer holds the flights of a Coalesce RoundTripper by key.
+type coalescer struct {
+	next    http.RoundTripper
+	headers []string
+	flights map[string]*flight
+	mutex   sync.Mutex
+}
+
+// Coalesce returns middleware that coalesces concurrent identical GET and HEAD
+// requests into a single round trip. Requests are identical if they share
+// method, URL, credentials in the Authorization and Cookie header fields, and
+// the values of the header fields named in headers; list any other field,
+// such as Accept, that changes the response.
+//
+// Every caller gets its own copy of the response, whose body is read in full
+// by the shared round trip. The shared round trip does not belong to any one
+// caller, so it runs with a background context: values in the context of a
+// caller's request, such as an httptrace.ClientTrace, do not apply to it. A
+// caller whose context is done stops waiting with its context error; the
+// shared round trip is canceled only once every caller has stopped waiting.
+// Requests with other methods, or with a body, pass through.
+func Coalesce(headers ...string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		c := &coalescer{next: next, headers: headers, flights: map[string]*flight{}}
+		return RoundTripperFunc(c.roundTrip)
+	}
+}
+
+// credentialHeaders are the header fields always part of a coalescer key, so
+// that a response is never shared with a caller holding other credentials.
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// key returns the key under which r is coalesced.
+func (c *coalescer) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.String())
+	for _, name := range slices.Concat(credentialHeaders, c.headers) {
+		b.WriteByte('\n')
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c *coalescer) roundTrip(r *http.Request) (*http.Response, error) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || (r.Body != nil && r.Body != http.NoBody) {
+		return c.next.RoundTrip(r)
+	}
+
+	key := c.key(r)
+
+	c.mutex.Lock()
+	f, ok := c.flights[key]
+	if !ok {
+		// the shared round trip must outlive, and not report to, any one caller
+		ctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[key] = f
+		go c.fly(key, f, r.Clone(ctx))
+	}
+	f.waiters++
+	c.mutex.Unlock()
+
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		c.leave(key, f)
+		return nil, r.Context().Err()
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Trailer = f.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(f.body))
+	resp.Request = r
+
+	return &resp, nil
+}
+
+// fly makes the shared round trip of f for req.
+func (c *coalescer) fly(key string, f *flight, req *http.Request) {
+	defer f.cancel()
+
+	resp, err := c.next.RoundTrip(req)
+	if err == nil {
+		f.body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = nil
+		f.resp = resp
+	}
+	f.err = err
+
+	c.mutex.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mutex.Unlock()
+
+	close(f.done)
+}
+
+// leave stops a caller waiting on f, canceling f if no caller is left.
+func (c *coalescer) leave(key string, f *flight) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		// later callers must not join a canceled flight
+		if c.flights[key] == f {
+			delete(c.flights, key)
+		}
+	}
+}
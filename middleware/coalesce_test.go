@@ -0,0 +1,263 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedTripper answers every round trip with body once release is closed,
+// or with the request context error if it is done first.
+type gatedTripper struct {
+	release chan struct{}
+	calls   atomic.Int32
+	ctxErr  atomic.Value
+}
+
+func (g *gatedTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	g.calls.Add(1)
+	select {
+	case <-g.release:
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("shared")), Request: r}, nil
+	case <-r.Context().Done():
+		g.ctxErr.Store(r.Context().Err())
+		return nil, r.Context().Err()
+	}
+}
+
+// waitForWaiters blocks until n callers wait on the flight of r.
+func waitForWaiters(t *testing.T, c *coalescer, r *http.Request, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); ; {
+		c.mutex.Lock()
+		f := c.flights[c.key(r)]
+		got := 0
+		if f != nil {
+			got = f.waiters
+		}
+		c.mutex.Unlock()
+
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v waiters, want %v", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	const callers = 10
+
+	g := &gatedTripper{release: make(chan struct{})}
+	c := &coalescer{next: g, flights: map[string]*flight{}}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/data", nil)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.roundTrip(r.Clone(context.Background()))
+			if err != nil {
+				t.Errorf("got error %v, want nil", err)
+				return
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			bodies[i] = string(data)
+		}()
+	}
+
+	waitForWaiters(t, c, r, callers)
+	close(g.release)
+	wg.Wait()
+
+	if got := g.calls.Load(); got != 1 {
+		t.Errorf("got %v upstream calls, want 1", got)
+	}
+	for i, body := range bodies {
+		if body != "shared" {
+			t.Errorf("caller %d: got body '%v', want 'shared'", i, body)
+		}
+	}
+}
+
+// headerRequest returns a GET request with the header field name set to
+// value.
+func headerRequest(name, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set(name, value)
+	return r
+}
+
+func TestCoalesce_Key(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   []string
+		a, b      *http.Request
+		wantCalls int32
+	}{
+		{
+			name:      "must_share_identical_requests",
+			a:         httptest.NewRequest(http.MethodGet, "http://example.com/", nil),
+			b:         httptest.NewRequest(http.MethodGet, "http://example.com/", nil),
+			wantCalls: 1,
+		},
+		{
+			name:      "must_split_on_url",
+			a:         httptest.NewRequest(http.MethodGet, "http://example.com/a", nil),
+			b:         httptest.NewRequest(http.MethodGet, "http://example.com/b", nil),
+			wantCalls: 2,
+		},
+		{
+			name:      "must_split_on_selected_header",
+			headers:   []string{"Accept"},
+			a:         headerRequest("Accept", "a"),
+			b:         headerRequest("Accept", "b"),
+			wantCalls: 2,
+		},
+		{
+			name:      "must_split_on_authorization",
+			a:         headerRequest("Authorization", "Bearer a"),
+			b:         headerRequest("Authorization", "Bearer b"),
+			wantCalls: 2,
+		},
+		{
+			name:      "must_split_on_cookie",
+			a:         headerRequest("Cookie", "session=a"),
+			b:         headerRequest("Cookie", "session=b"),
+			wantCalls: 2,
+		},
+		{
+			name:      "must_pass_through_post",
+			a:         httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("x")),
+			b:         httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("x")),
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &gatedTripper{release: make(chan struct{})}
+			transport := Coalesce(tt.headers...)(g)
+
+			var wg sync.WaitGroup
+			for _, r := range []*http.Request{tt.a, tt.b} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := transport.RoundTrip(r); err != nil {
+						t.Errorf("got error %v, want nil", err)
+					}
+				}()
+			}
+
+			for deadline := time.Now().Add(time.Second); g.calls.Load() < tt.wantCalls; {
+				if time.Now().After(deadline) {
+					t.Fatalf("got %v upstream calls, want %v", g.calls.Load(), tt.wantCalls)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond) // let a wrongly split request call upstream
+			close(g.release)
+			wg.Wait()
+
+			if got := g.calls.Load(); got != tt.wantCalls {
+				t.Errorf("got %v upstream calls, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCoalesce_Context(t *testing.T) {
+	type key struct{}
+
+	var got any
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		got = r.Context().Value(key{})
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/data", nil)
+	resp, err := Coalesce()(tripper).RoundTrip(r.WithContext(context.WithValue(r.Context(), key{}, "first caller")))
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	resp.Body.Close()
+
+	// the shared round trip must not carry the values of one caller
+	if got != nil {
+		t.Errorf("got context value %v in shared call, want nil", got)
+	}
+}
+
+func TestCoalesce_Cancel(t *testing.T) {
+	g := &gatedTripper{release: make(chan struct{})}
+	c := &coalescer{next: g, flights: map[string]*flight{}}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/data", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := c.roundTrip(r.WithContext(ctx))
+		canceled <- err
+	}()
+	done := make(chan error)
+	go func() {
+		resp, err := c.roundTrip(r.Clone(context.Background()))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	waitForWaiters(t, c, r, 2)
+
+	// one caller leaving must not cancel the call for the other
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v for canceled caller, want %v", err, context.Canceled)
+	}
+	close(g.release)
+	if err := <-done; err != nil {
+		t.Errorf("got error %v for waiting caller, want nil", err)
+	}
+	if err := g.ctxErr.Load(); err != nil {
+		t.Errorf("got shared call error %v, want none", err)
+	}
+}
+
+func TestCoalesce_CancelAll(t *testing.T) {
+	g := &gatedTripper{release: make(chan struct{})}
+	c := &coalescer{next: g, flights: map[string]*flight{}}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/data", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := c.roundTrip(r.WithContext(ctx))
+		canceled <- err
+	}()
+	waitForWaiters(t, c, r, 1)
+
+	cancel()
+	<-canceled
+
+	// the last caller leaving cancels the shared call
+	for deadline := time.Now().Add(time.Second); g.ctxErr.Load() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got shared call still running, want canceled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// dumpOptions holds the optional configuration of a WireDump RoundTripper.
+type dumpOptions struct {
+	logger    *slog.Logger
+	prefix    string
+	writer    io.Writer
+	headers   []string
+	fields    []string
+	bodyLimit int
+}
+
+// DumpOption is a function that sets a WireDump option.
+type DumpOption func(*dumpOptions)
+
+// WithDumpLogger sets WireDump to log dumps to logger at Debug level, with
+// prefix as the message.
+func WithDumpLogger(logger *slog.Logger, prefix string) DumpOption {
+	return func(o *dumpOptions) {
+		o.logger = logger
+		o.prefix = prefix
+	}
+}
+
+// WithDumpWriter sets WireDump to write dumps to w instead of a logger.
+// Writes are serialized, so w need not be safe for concurrent use.
+func WithDumpWriter(w io.Writer) DumpOption {
+	return func(o *dumpOptions) { o.writer = w }
+}
+
+// WithDumpRedactHeaders sets WireDump to redact the values of the header
+// fields named in names, replacing DefaultDumpRedactHeaders.
+func WithDumpRedactHeaders(names ...string) DumpOption {
+	return func(o *dumpOptions) { o.headers = names }
+}
+
+// WithDumpRedactFields sets WireDump to redact the scalar values of the JSON
+// object fields named in names, at any depth, in dumped bodies. Names are
+// matched exactly.
+func WithDumpRedactFields(names ...string) DumpOption {
+	return func(o *dumpOptions) { o.fields = names }
+}
+
+// WithDumpBodyLimit sets WireDump to dump at most limit bytes of each body. A
+// negative limit omits bodies; a limit of 0 means the default.
+func WithDumpBodyLimit(limit int) DumpOption {
+	return func(o *dumpOptions) { o.bodyLimit = limit }
+}
+
+// DefaultDumpRedactHeaders are the header fields whose values WireDump
+// redacts if no others are supplied.
+var DefaultDumpRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// DefaultRedactQuery are the query parameters whose values Cassette and
+// HARRecorder redact if no others are supplied.
+var DefaultRedactQuery = []string{"access_token", "api_key", "apikey", "client_secret", "key", "password", "sig", "signature", "token"}
+
+// redacted replaces redacted header field and JSON field values in dumps.
+const redacted = "[REDACTED]"
+
+// WireDump returns middleware that dumps requests and responses as sent and
+// received over the wire, using httputil.DumpRequestOut and
+// httputil.DumpResponse, to debug integrations. Redacted header fields, and
+// JSON fields if any are configured, are replaced by "[REDACTED]", and bodies
+// longer than the body limit are truncated in the dump.
+//
+// Bodies are copied into the dump as they are read, so request and response
+// bodies reach the next RoundTripper and the caller intact, and streamed
+// responses are not held up. A round trip is dumped once the caller has read
+// the response body to its end or closed it, or at once if it failed.
+//
+// If no logger or writer options are supplied, dumps are logged to
+// slog.Default() at Debug level. The default body limit is 4096 bytes.
+func WireDump(opts ...DumpOption) func(http.RoundTripper) http.RoundTripper {
+	o := dumpOptions{headers: DefaultDumpRedactHeaders}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.writer == nil && o.logger == nil {
+		o.logger = slog.Default()
+	}
+	if o.bodyLimit == 0 {
+		o.bodyLimit = 4096
+	}
+
+	fields := jsonFieldPattern(o.fields)
+
+	var mutex sync.Mutex
+	write := func(r *http.Request, req, resp []byte, err error) {
+		if o.writer != nil {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			fmt.Fprintf(o.writer, "%s\n", req)
+			if err != nil {
+				fmt.Fprintf(o.writer, "error: %s\n\n", err.Error())
+			} else {
+				fmt.Fprintf(o.writer, "%s\n\n", resp)
+			}
+			return
+		}
+
+		attrs := []slog.Attr{slog.String("request", string(req))}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		} else {
+			attrs = append(attrs, slog.String("response", string(resp)))
+		}
+		o.logger.LogAttrs(r.Context(), slog.LevelDebug, o.prefix, attrs...)
+	}
+
+	// tee returns body copying into buf as it is read, calling done once it
+	// is read to its end or closed
+	tee := func(body io.ReadCloser, buf *dumpBuffer, done func()) io.ReadCloser {
+		if body == nil || body == http.NoBody || o.bodyLimit < 0 {
+			if done != nil {
+				done()
+			}
+			return body
+		}
+		return &teeBody{ReadCloser: body, buf: buf, done: done}
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// RoundTrippers must not modify the request
+			req := r.Clone(r.Context())
+			reqBody := &dumpBuffer{limit: o.bodyLimit}
+			req.Body = tee(r.Body, reqBody, nil)
+
+			shown := req.Clone(req.Context())
+			shown.Header = redactHeader(req.Header, o.headers)
+			reqDump, err := httputil.DumpRequestOut(shown, false)
+			if err != nil {
+				reqDump = []byte(fmt.Sprintf("%s %s: dump failed: %s\n", req.Method, req.URL, err.Error()))
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				write(r, append(reqDump, reqBody.dump(fields)...), nil, err)
+				return resp, err
+			}
+
+			shownResp := *resp
+			shownResp.Header = redactHeader(resp.Header, o.headers)
+			shownResp.Body = nil
+			respDump, dumpErr := httputil.DumpResponse(&shownResp, false)
+			if dumpErr != nil {
+				respDump = []byte(fmt.Sprintf("%s: dump failed: %s\n", resp.Status, dumpErr.Error()))
+			}
+
+			respBody := &dumpBuffer{limit: o.bodyLimit}
+			resp.Body = tee(resp.Body, respBody, func() {
+				write(r, append(reqDump, reqBody.dump(fields)...), append(respDump, respBody.dump(fields)...), nil)
+			})
+
+			return resp, nil
+		})
+	}
+}
+
+// dumpBuffer keeps the first limit bytes written to it and counts the rest.
+// The request body may be written by the transport while the response is
+// read, so it is guarded by mutex.
+type dumpBuffer struct {
+	data  []byte
+	size  int
+	limit int
+	mutex sync.Mutex
+}
+
+func (b *dumpBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	keep := max(min(len(p), b.limit-len(b.data)), 0)
+	b.data = append(b.data, p[:keep]...)
+	b.size += len(p)
+	return len(p), nil
+}
+
+// contents returns a copy of the kept bytes, the number of bytes written, and
+// whether bytes were dropped.
+func (b *dumpBuffer) contents() (data []byte, size int, truncated bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return bytes.Clone(b.data), b.size, b.size > len(b.data)
+}
+
+// dump returns the kept bytes with the values matched by fields redacted,
+// marked if bytes were dropped.
+func (b *dumpBuffer) dump(fields *regexp.Regexp) []byte {
+	data, _, truncated := b.contents()
+
+	dump := redactJSONFields(fields, data)
+	if truncated {
+		dump = append(dump, "\n[truncated]"...)
+	}
+	return dump
+}
+
+// teeBody is a body that copies what is read through it into buf and calls
+// done, if set, once it is read to its end, fails or is closed.
+type teeBody struct {
+	io.ReadCloser
+	buf  *dumpBuffer
+	done func()
+	once sync.Once
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *teeBody) finish() {
+	if b.done != nil {
+		b.once.Do(b.done)
+	}
+}
+
+// redactHeader returns a copy of h with the values of the fields named in
+// names replaced.
+func redactHeader(h http.Header, names []string) http.Header {
+	h = h.Clone()
+	for _, name := range names {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, redacted)
+		}
+	}
+	return h
+}
+
+// redactQuery returns u as a string with the values of the query parameters
+// named in names replaced by redacted. The other parameters are kept as they
+// are, in order and with their encoding.
+func redactQuery(u *url.URL, names []string) string {
+	if len(names) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		name := key
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			name = unescaped
+		}
+		if slices.Contains(names, name) {
+			params[i] = key + "=" + redacted
+		}
+	}
+
+	redactedURL := *u
+	redactedURL.RawQuery = strings.Join(params, "&")
+	return redactedURL.String()
+}
+
+// jsonFieldPattern returns a pattern matching the scalar values of the JSON
+// object fields named in names, or nil if names is empty. A string value may
+// be cut short, as by truncation.
+func jsonFieldPattern(names []string) *regexp.Regexp {
+	if len(names) == 0 {
+		return nil
+	}
+
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+
+	return regexp.MustCompile(`("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)(?:"(?:[^"\\]|\\.)*(?:"|\\?$)|[-+0-9.eE]+|true|false|null)`)
+}
+
+// redactJSONFields returns data with the values matched by fields replaced.
+// A nil fields returns data unchanged.
+func redactJSONFields(fields *regexp.Regexp, data []byte) []byte {
+	if fields == nil {
+		return data
+	}
+	return fields.ReplaceAll(data, []byte(`${1}"`+redacted+`"`))
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWireDump(t *testing.T) {
+	const reqBody = `{"user":"ann","password":"hunter2","nested":{"token":123}}`
+	const respBody = `{"id":7,"secret":"s3cr3t-value-that-is-long"}`
+
+	tests := []struct {
+		name      string
+		opts      []DumpOption
+		want      []string
+		wantNotIn []string
+	}{
+		{
+			name: "must_redact_default_headers",
+			want: []string{
+				"POST /login HTTP/1.1",
+				"Authorization: [REDACTED]",
+				"X-Trace: abc",
+				"HTTP/1.1 200 OK",
+				"Set-Cookie: [REDACTED]",
+				reqBody,
+				respBody,
+			},
+			wantNotIn: []string{"Bearer t0k3n", "session=1"},
+		},
+		{
+			name: "must_redact_supplied_headers",
+			opts: []DumpOption{WithDumpRedactHeaders("X-Trace")},
+			want: []string{"Authorization: Bearer t0k3n", "X-Trace: [REDACTED]"},
+		},
+		{
+			name: "must_redact_json_fields",
+			opts: []DumpOption{WithDumpRedactFields("password", "token", "secret")},
+			want: []string{
+				`"user":"ann"`,
+				`"password":"[REDACTED]"`,
+				`"token":"[REDACTED]"`,
+				`"secret":"[REDACTED]"`,
+			},
+			wantNotIn: []string{"hunter2", "123", "s3cr3t"},
+		},
+		{
+			name:      "must_truncate_bodies",
+			opts:      []DumpOption{WithDumpBodyLimit(10)},
+			want:      []string{`{"user":"a` + "\n[truncated]", `{"id":7,"s` + "\n[truncated]"},
+			wantNotIn: []string{"hunter2", "s3cr3t"},
+		},
+		{
+			name:      "must_redact_json_field_cut_by_truncation",
+			opts:      []DumpOption{WithDumpBodyLimit(20), WithDumpRedactFields("secret")},
+			want:      []string{`"secret":"[REDACTED]"`},
+			wantNotIn: []string{"s3"},
+		},
+		{
+			name:      "must_omit_bodies_on_negative_limit",
+			opts:      []DumpOption{WithDumpBodyLimit(-1)},
+			wantNotIn: []string{reqBody, respBody},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				received = string(data)
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+				w.Write([]byte(respBody))
+			}))
+			defer server.Close()
+
+			var buf bytes.Buffer
+			transport := WireDump(append([]DumpOption{WithDumpWriter(&buf)}, tt.opts...)...)(server.Client().Transport)
+
+			r, err := http.NewRequest(http.MethodPost, server.URL+"/login", strings.NewReader(reqBody))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err.Error())
+			}
+			r.Header.Set("Authorization", "Bearer t0k3n")
+			r.Header.Set("X-Trace", "abc")
+
+			resp, err := transport.RoundTrip(r)
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// bodies and the caller's request must be left intact
+			if received != reqBody {
+				t.Errorf("got request body '%s', want '%s'", received, reqBody)
+			}
+			if string(data) != respBody {
+				t.Errorf("got response body '%s', want '%s'", data, respBody)
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer t0k3n" {
+				t.Errorf("got Authorization '%s' after dump, want unchanged", got)
+			}
+
+			got := buf.String()
+			for _, sub := range tt.want {
+				if !strings.Contains(got, sub) {
+					t.Errorf("'%s' does not contain '%s'", got, sub)
+				}
+			}
+			for _, sub := range tt.wantNotIn {
+				if strings.Contains(got, sub) {
+					t.Errorf("'%s' contains '%s'", got, sub)
+				}
+			}
+		})
+	}
+}
+
+func TestWireDump_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("simulated network error")
+	})
+
+	_, err := WireDump(WithDumpLogger(logger, "wire"))(tripper).RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if err == nil {
+		t.Fatalf("got nil error, want error")
+	}
+
+	got := buf.String()
+	for _, sub := range []string{"level=DEBUG", "msg=wire", "request=\"GET / HTTP/1.1", `error="simulated network error"`} {
+		if !strings.Contains(got, sub) {
+			t.Errorf("'%s' does not contain '%s'", got, sub)
+		}
+	}
+}
+
+func TestWireDump_ReadError(t *testing.T) {
+	var got error
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		_, got = io.ReadAll(r.Body)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", errReader{})
+	if _, err := WireDump(WithDumpWriter(io.Discard))(tripper).RoundTrip(r); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if got == nil {
+		t.Errorf("got nil body read error downstream, want error")
+	}
+}
+
+func TestWireDump_Stream(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "event: done\n\n")
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var buf syncBuffer
+	transport := WireDump(WithDumpWriter(&buf))(server.Client().Transport)
+
+	// the round trip must not wait for the streamed body
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, server.URL, nil).WithContext(t.Context()))
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if got := buf.String(); got != "" {
+		t.Errorf("got dump '%s' before the body was read, want none", got)
+	}
+
+	release <- struct{}{}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(data) != "event: done\n\n" {
+		t.Errorf("got body '%s', want 'event: done'", data)
+	}
+	if got := buf.String(); !strings.Contains(got, "HTTP/1.1 200 OK") || !strings.Contains(got, "event: done") {
+		t.Errorf("got dump '%s', want the response and its body", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
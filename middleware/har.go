@@ -0,0 +1,492 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harLog is the root of an HTTP Archive 1.2 document.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harPair    `json:"cookies"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings holds phase durations in milliseconds; -1 marks a phase that did
+// not apply.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harOptions holds the optional configuration of a HARRecorder.
+type harOptions struct {
+	headers   []string
+	query     []string
+	fields    []string
+	bodyLimit int
+}
+
+// HAROption is a function that sets a HARRecorder option.
+type HAROption func(*harOptions)
+
+// WithHARRedactHeaders sets HARRecorder to redact the values of the header
+// fields named in names, replacing DefaultDumpRedactHeaders; with no names,
+// nothing is redacted. Redacting Cookie or Set-Cookie also redacts the values
+// of the recorded cookies.
+func WithHARRedactHeaders(names ...string) HAROption {
+	return func(o *harOptions) { o.headers = names }
+}
+
+// WithHARRedactQuery sets HARRecorder to redact the values of the query
+// parameters named in names, in request URLs and query strings, replacing
+// DefaultRedactQuery; with no names, nothing is redacted.
+func WithHARRedactQuery(names ...string) HAROption {
+	return func(o *harOptions) { o.query = names }
+}
+
+// WithHARRedactFields sets HARRecorder to redact the scalar values of the
+// JSON object fields named in names, at any depth, in recorded bodies.
+func WithHARRedactFields(names ...string) HAROption {
+	return func(o *harOptions) { o.fields = names }
+}
+
+// WithHARBodyLimit sets HARRecorder to record at most limit bytes of each
+// body. A negative limit omits bodies; a limit of 0 means the default.
+func WithHARBodyLimit(limit int) HAROption {
+	return func(o *harOptions) { o.bodyLimit = limit }
+}
+
+// HARRecorder records round trips as entries of an HTTP Archive (HAR) 1.2
+// document, which browser developer tools and other HAR viewers can open.
+// Entries hold request and response headers, cookies and bodies, and timings
+// traced with httptrace. It is safe for concurrent use.
+type HARRecorder struct {
+	path      string
+	headers   []string
+	query     []string
+	fields    *regexp.Regexp
+	bodyLimit int
+
+	entries []*harEntry
+	mutex   sync.Mutex
+}
+
+// NewHARRecorder returns a new HARRecorder that flushes to the file at path.
+// By default, it redacts DefaultDumpRedactHeaders and DefaultRedactQuery and
+// records at most 1 MiB of each body.
+func NewHARRecorder(path string, opts ...HAROption) *HARRecorder {
+	o := harOptions{headers: DefaultDumpRedactHeaders, query: DefaultRedactQuery}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.bodyLimit == 0 {
+		o.bodyLimit = 1 << 20
+	}
+
+	return &HARRecorder{path: path, headers: o.headers, query: o.query, fields: jsonFieldPattern(o.fields), bodyLimit: o.bodyLimit}
+}
+
+// Record is middleware that records every round trip made through next.
+// Bodies are recorded as they are read, by the transport and by the caller,
+// so an entry is complete once the response body is read to the end or
+// closed.
+func (rec *HARRecorder) Record(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// RoundTrippers must not modify the request
+		req := r.Clone(r.Context())
+
+		reqBody := &dumpBuffer{limit: max(rec.bodyLimit, 0)}
+		if r.Body != nil && r.Body != http.NoBody {
+			req.Body = &teeBody{ReadCloser: r.Body, buf: reqBody}
+		}
+
+		trace := &harTrace{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+		trace.start = time.Now()
+		resp, err := next.RoundTrip(req)
+		trace.done = time.Now()
+
+		entry := &harEntry{
+			StartedDateTime: trace.start.Format(time.RFC3339Nano),
+			Request:         rec.request(req, reqBody),
+		}
+
+		if err != nil {
+			entry.Response = harResponse{Cookies: []harPair{}, Headers: []harPair{}, HeadersSize: -1, BodySize: -1}
+			entry.Comment = err.Error()
+			entry.Timings, entry.Time = trace.timings(trace.done)
+			entry.ServerIPAddress = trace.serverIP()
+			rec.add(entry)
+			return nil, err
+		}
+
+		entry.Response = rec.response(resp)
+		entry.Timings, entry.Time = trace.timings(trace.done)
+		entry.ServerIPAddress = trace.serverIP()
+		rec.add(entry)
+
+		resp.Body = &harBody{
+			ReadCloser: resp.Body,
+			rec:        rec,
+			entry:      entry,
+			trace:      trace,
+			reqBody:    reqBody,
+			reqType:    req.Header.Get("Content-Type"),
+			buf:        &dumpBuffer{limit: max(rec.bodyLimit, 0)},
+		}
+
+		return resp, nil
+	})
+}
+
+// add appends entry to the recorded entries.
+func (rec *HARRecorder) add(entry *harEntry) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	rec.entries = append(rec.entries, entry)
+}
+
+// request returns the HAR representation of r with the body read so far.
+func (rec *HARRecorder) request(r *http.Request, body *dumpBuffer) harRequest {
+	req := harRequest{
+		Method:      r.Method,
+		URL:         redactQuery(r.URL, rec.query),
+		HTTPVersion: r.Proto,
+		Cookies:     harCookies(r.Cookies(), rec.redacts("Cookie")),
+		Headers:     harHeaders(redactHeader(r.Header, rec.headers)),
+		QueryString: []harPair{},
+		HeadersSize: -1,
+	}
+	if req.HTTPVersion == "" {
+		req.HTTPVersion = "HTTP/1.1"
+	}
+
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			if slices.Contains(rec.query, name) {
+				v = redacted
+			}
+			req.QueryString = append(req.QueryString, harPair{Name: name, Value: v})
+		}
+	}
+
+	rec.setPostData(&req, r.Header.Get("Content-Type"), body)
+
+	return req
+}
+
+// setPostData sets the body size and post data of req from body.
+func (rec *HARRecorder) setPostData(req *harRequest, mimeType string, body *dumpBuffer) {
+	data, size, truncated := body.contents()
+	req.BodySize = size
+	if size == 0 {
+		return
+	}
+
+	req.PostData = &harPostData{MimeType: mimeType}
+	if rec.bodyLimit >= 0 {
+		req.PostData.Text = string(redactJSONFields(rec.fields, data))
+	}
+	if truncated {
+		req.PostData.Comment = "truncated"
+	}
+}
+
+// response returns the HAR representation of resp, without its body.
+func (rec *HARRecorder) response(resp *http.Response) harResponse {
+	return harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies(), rec.redacts("Set-Cookie")),
+		Headers:     harHeaders(redactHeader(resp.Header, rec.headers)),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+// redacts reports whether the header field name is redacted.
+func (rec *HARRecorder) redacts(name string) bool {
+	for _, h := range rec.headers {
+		if http.CanonicalHeaderKey(h) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTo writes the recorded entries to w as a HAR document.
+func (rec *HARRecorder) WriteTo(w io.Writer) (int64, error) {
+	data, err := rec.marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// Flush writes the recorded entries to the recorder's file as a HAR
+// document, replacing the file.
+func (rec *HARRecorder) Flush() error {
+	data, err := rec.marshal()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(rec.path, data)
+}
+
+// Close flushes the recorded entries.
+func (rec *HARRecorder) Close() error { return rec.Flush() }
+
+// marshal returns the recorded entries as a HAR document.
+func (rec *HARRecorder) marshal() ([]byte, error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	doc := struct {
+		Log harLog `json:"log"`
+	}{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "github.com/novrin/web/middleware", Version: "1.0"},
+			Entries: make([]harEntry, len(rec.entries)),
+		},
+	}
+	for i, e := range rec.entries {
+		doc.Log.Entries[i] = *e
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// harHeaders returns h as HAR name-value pairs.
+func harHeaders(h http.Header) []harPair {
+	pairs := []harPair{}
+	for name, values := range h {
+		for _, v := range values {
+			pairs = append(pairs, harPair{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+// harCookies returns cookies as HAR name-value pairs, with their values
+// replaced if redact is true.
+func harCookies(cookies []*http.Cookie, redact bool) []harPair {
+	pairs := []harPair{}
+	for _, c := range cookies {
+		value := c.Value
+		if redact {
+			value = redacted
+		}
+		pairs = append(pairs, harPair{Name: c.Name, Value: value})
+	}
+	return pairs
+}
+
+// harBody records a response body into its entry as it is read, completing
+// the entry on EOF or Close.
+type harBody struct {
+	io.ReadCloser
+	rec     *HARRecorder
+	entry   *harEntry
+	trace   *harTrace
+	reqBody *dumpBuffer
+	reqType string
+	buf     *dumpBuffer
+	once    sync.Once
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// finish fills in the response content and receive timing of the entry,
+// and the post data in case the transport read the request body late.
+func (b *harBody) finish() {
+	b.once.Do(func() {
+		end := time.Now()
+		data, size, truncated := b.buf.contents()
+
+		b.rec.mutex.Lock()
+		defer b.rec.mutex.Unlock()
+
+		b.rec.setPostData(&b.entry.Request, b.reqType, b.reqBody)
+
+		content := &b.entry.Response.Content
+		content.Size = size
+		switch {
+		case b.rec.bodyLimit < 0:
+		case utf8.Valid(data):
+			content.Text = string(redactJSONFields(b.rec.fields, data))
+		default:
+			content.Text = base64.StdEncoding.EncodeToString(data)
+			content.Encoding = "base64"
+		}
+		if truncated {
+			content.Comment = "truncated"
+		}
+		b.entry.Response.BodySize = size
+		b.entry.Timings, b.entry.Time = b.trace.timings(end)
+	})
+}
+
+// harTrace is a timingTrace with the times the round trip started and
+// returned, for transports that are not traced.
+type harTrace struct {
+	timingTrace
+	start, done time.Time
+}
+
+// serverIP returns the IP address of the server, if it was traced.
+func (t *harTrace) serverIP() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.remote
+}
+
+// timings returns the HAR timings of the round trip ended at end, and their
+// total in milliseconds.
+func (t *harTrace) timings(end time.Time) (harTimings, float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return -1
+		}
+		return float64(max(to.Sub(from), 0)) / float64(time.Millisecond)
+	}
+
+	timings := harTimings{
+		DNS:     ms(t.dnsStart, t.dnsDone),
+		Connect: ms(t.connectStart, t.connectDone),
+		SSL:     ms(t.tlsStart, t.tlsDone),
+		Blocked: -1,
+	}
+
+	// HAR counts the TLS handshake as part of connecting
+	if timings.Connect >= 0 && timings.SSL >= 0 {
+		timings.Connect = ms(t.connectStart, t.tlsDone)
+	}
+
+	if t.gotConn.IsZero() {
+		// untraced transports only tell the time to return
+		timings.Send = 0
+		timings.Wait = ms(t.start, t.done)
+		timings.Receive = ms(t.done, end)
+	} else {
+		timings.Blocked = ms(t.start, t.gotConn) - max(timings.DNS, 0) - max(timings.Connect, 0)
+		timings.Blocked = max(timings.Blocked, 0)
+		wrote := t.wrote
+		if wrote.IsZero() {
+			wrote = t.gotConn
+		}
+		firstByte := t.firstByte
+		if firstByte.IsZero() {
+			firstByte = t.done
+		}
+		timings.Send = ms(t.gotConn, wrote)
+		timings.Wait = ms(wrote, firstByte)
+		timings.Receive = ms(firstByte, end)
+	}
+
+	total := 0.0
+	for _, d := range []float64{timings.Blocked, timings.DNS, timings.Connect, timings.Send, timings.Wait, timings.Receive} {
+		total += max(d, 0)
+	}
+
+	return timings, total
+}
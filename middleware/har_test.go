@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// harDoc is the subset of a HAR document checked by tests.
+type harDoc struct {
+	Log struct {
+		Version string `json:"version"`
+		Entries []struct {
+			Time     float64 `json:"time"`
+			Comment  string  `json:"comment"`
+			Request  harRequest
+			Response harResponse
+			Timings  harTimings `json:"timings"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// pair returns the value of the pair named name, or "" if there is none.
+func pair(pairs []harPair, name string) string {
+	for _, p := range pairs {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func TestHARRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/binary" {
+			w.Write([]byte{0xff, 0xfe})
+			return
+		}
+		w.Write([]byte(`{"id":1,"token":"t0k3n"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		opts []HAROption
+		path string
+		want func(t *testing.T, doc harDoc)
+	}{
+		{
+			name: "must_record_request_and_response",
+			opts: []HAROption{WithHARRedactHeaders()},
+			path: "/login?next=home",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if e.Request.Method != http.MethodPost || !strings.HasSuffix(e.Request.URL, "/login?next=home") {
+					t.Errorf("got request %v %v, want POST .../login?next=home", e.Request.Method, e.Request.URL)
+				}
+				if got := pair(e.Request.QueryString, "next"); got != "home" {
+					t.Errorf("got query next '%v', want 'home'", got)
+				}
+				if got := pair(e.Request.Cookies, "pref"); got != "dark" {
+					t.Errorf("got request cookie '%v', want 'dark'", got)
+				}
+				if e.Request.PostData == nil || e.Request.PostData.Text != `{"password":"hunter2"}` {
+					t.Errorf("got post data %+v, want body", e.Request.PostData)
+				}
+				if e.Response.Status != http.StatusOK || e.Response.StatusText != "OK" {
+					t.Errorf("got status %v %v, want 200 OK", e.Response.Status, e.Response.StatusText)
+				}
+				if got := pair(e.Response.Cookies, "session"); got != "abc" {
+					t.Errorf("got response cookie '%v', want 'abc'", got)
+				}
+				if e.Response.Content.Text != `{"id":1,"token":"t0k3n"}` || e.Response.Content.Size != 24 {
+					t.Errorf("got content %+v, want body of size 24", e.Response.Content)
+				}
+				if e.Timings.Connect < 0 || e.Timings.Wait < 0 || e.Timings.Receive < 0 {
+					t.Errorf("got timings %+v, want traced connect, wait and receive", e.Timings)
+				}
+			},
+		},
+		{
+			name: "must_redact_headers_cookies_and_fields",
+			opts: []HAROption{
+				WithHARRedactHeaders("Authorization", "Cookie", "Set-Cookie"),
+				WithHARRedactFields("password", "token"),
+			},
+			path: "/login",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if got := pair(e.Request.Headers, "Authorization"); got != redacted {
+					t.Errorf("got Authorization '%v', want '%v'", got, redacted)
+				}
+				if got := pair(e.Request.Cookies, "pref"); got != redacted {
+					t.Errorf("got request cookie '%v', want '%v'", got, redacted)
+				}
+				if got := pair(e.Response.Cookies, "session"); got != redacted {
+					t.Errorf("got response cookie '%v', want '%v'", got, redacted)
+				}
+				if got := e.Request.PostData.Text; got != `{"password":"[REDACTED]"}` {
+					t.Errorf("got post data '%v', want password redacted", got)
+				}
+				if got := e.Response.Content.Text; got != `{"id":1,"token":"[REDACTED]"}` {
+					t.Errorf("got content '%v', want token redacted", got)
+				}
+			},
+		},
+		{
+			name: "must_redact_default_headers",
+			path: "/login",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if got := pair(e.Request.Headers, "Authorization"); got != redacted {
+					t.Errorf("got Authorization '%v', want '%v'", got, redacted)
+				}
+				if got := pair(e.Response.Cookies, "session"); got != redacted {
+					t.Errorf("got response cookie '%v', want '%v'", got, redacted)
+				}
+			},
+		},
+		{
+			name: "must_redact_default_query",
+			path: "/login?api_key=k3y&next=home",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if !strings.HasSuffix(e.Request.URL, "/login?api_key=[REDACTED]&next=home") {
+					t.Errorf("got URL '%v', want api_key redacted", e.Request.URL)
+				}
+				if got := pair(e.Request.QueryString, "api_key"); got != redacted {
+					t.Errorf("got query api_key '%v', want '%v'", got, redacted)
+				}
+				if got := pair(e.Request.QueryString, "next"); got != "home" {
+					t.Errorf("got query next '%v', want 'home'", got)
+				}
+			},
+		},
+		{
+			name: "must_truncate_bodies",
+			opts: []HAROption{WithHARBodyLimit(5)},
+			path: "/login",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if p := e.Request.PostData; p == nil || p.Text != `{"pas` || p.Comment != "truncated" || e.Request.BodySize != 22 {
+					t.Errorf("got post data %+v of size %v, want 5 of 22 bytes", p, e.Request.BodySize)
+				}
+				if c := e.Response.Content; c.Text != `{"id"` || c.Comment != "truncated" || c.Size != 24 {
+					t.Errorf("got content %+v, want 5 of 24 bytes", c)
+				}
+			},
+		},
+		{
+			name: "must_omit_bodies_on_negative_limit",
+			opts: []HAROption{WithHARBodyLimit(-1)},
+			path: "/login",
+			want: func(t *testing.T, doc harDoc) {
+				e := doc.Log.Entries[0]
+				if p := e.Request.PostData; p == nil || p.Text != "" || e.Request.BodySize != 22 {
+					t.Errorf("got post data %+v of size %v, want none of 22 bytes", p, e.Request.BodySize)
+				}
+				if c := e.Response.Content; c.Text != "" || c.Size != 24 {
+					t.Errorf("got content %+v, want none of 24 bytes", c)
+				}
+			},
+		},
+		{
+			name: "must_encode_binary_content",
+			path: "/binary",
+			want: func(t *testing.T, doc harDoc) {
+				c := doc.Log.Entries[0].Response.Content
+				if c.Encoding != "base64" || c.Text != "//4=" {
+					t.Errorf("got content %+v, want base64 '//4='", c)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := NewHARRecorder("", tt.opts...)
+			client := &http.Client{Transport: rec.Record(&http.Transport{})}
+
+			r, err := http.NewRequest(http.MethodPost, server.URL+tt.path, strings.NewReader(`{"password":"hunter2"}`))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err.Error())
+			}
+			r.Header.Set("Authorization", "Bearer t0k3n")
+			r.AddCookie(&http.Cookie{Name: "pref", Value: "dark"})
+
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			var buf bytes.Buffer
+			if _, err := rec.WriteTo(&buf); err != nil {
+				t.Fatalf("failed to write: %s", err.Error())
+			}
+
+			var doc harDoc
+			if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+				t.Fatalf("failed to unmarshal: %s", err.Error())
+			}
+			if doc.Log.Version != "1.2" {
+				t.Errorf("got version %v, want 1.2", doc.Log.Version)
+			}
+			if len(doc.Log.Entries) != 1 {
+				t.Fatalf("got %v entries, want 1", len(doc.Log.Entries))
+			}
+			tt.want(t, doc)
+		})
+	}
+}
+
+func TestHARRecorder_Error(t *testing.T) {
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("simulated network error")
+	})
+
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	rec := NewHARRecorder(path)
+	if _, err := rec.Record(tripper).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Fatalf("got nil error, want error")
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err.Error())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err.Error())
+	}
+
+	var doc harDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err.Error())
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("got %v entries, want 1", len(doc.Log.Entries))
+	}
+	if got := doc.Log.Entries[0].Comment; got != "simulated network error" {
+		t.Errorf("got comment '%v', want 'simulated network error'", got)
+	}
+}
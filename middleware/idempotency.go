@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// UUIDVersion selects the version of the UUIDs generated by IdempotencyKey.
+type UUIDVersion int
+
+const (
+	// UUIDv4 keys are random.
+	UUIDv4 UUIDVersion = 4
+	// UUIDv7 keys start with a millisecond Unix timestamp, so they sort by
+	// creation time, and are random otherwise.
+	UUIDv7 UUIDVersion = 7
+)
+
+// IdempotencyKey returns middleware that sets a newly generated UUID as the
+// header field "Idempotency-Key" on requests whose method is one of methods
+// and that do not carry the header already. If no methods are supplied, POST
+// and PATCH are used. Other requests pass through unchanged.
+//
+// A request with an Idempotency-Key is retried by Retry regardless of its
+// method, and the key lets the server recognize the retries as repeats. To
+// send the same key with every attempt, place IdempotencyKey outside Retry:
+//
+//	IdempotencyKey(UUIDv7)(Retry(policy)(http.DefaultTransport))
+//
+// Any version other than UUIDv7 is treated as UUIDv4.
+func IdempotencyKey(version UUIDVersion, methods ...string) func(http.RoundTripper) http.RoundTripper {
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost, http.MethodPatch}
+	}
+
+	allowed := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		allowed[m] = true
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if !allowed[r.Method] || r.Header.Get("Idempotency-Key") != "" {
+				return next.RoundTrip(r)
+			}
+
+			// RoundTrippers must not modify the request
+			req := r.Clone(r.Context())
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.Header.Set("Idempotency-Key", newUUID(version, time.Now()))
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// newUUID returns a random UUID of version, formatted as 36 characters. A
+// UUIDv7 embeds now.
+func newUUID(version UUIDVersion, now time.Time) string {
+	var u [16]byte
+	rand.Read(u[:])
+
+	if version == UUIDv7 {
+		var ms [8]byte
+		binary.BigEndian.PutUint64(ms[:], uint64(now.UnixMilli()))
+		copy(u[:6], ms[2:])
+		u[6] = u[6]&0x0f | 0x70
+	} else {
+		u[6] = u[6]&0x0f | 0x40
+	}
+	u[8] = u[8]&0x3f | 0x80 // RFC 9562 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+
+	return string(buf[:])
+}
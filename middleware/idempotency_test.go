@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		method  string
+		key     string
+		wantKey bool
+	}{
+		{name: "must_set_key_on_post", method: http.MethodPost, wantKey: true},
+		{name: "must_set_key_on_patch", method: http.MethodPatch, wantKey: true},
+		{name: "must_skip_get", method: http.MethodGet},
+		{name: "must_keep_existing_key", method: http.MethodPost, key: "abc", wantKey: true},
+		{name: "must_set_key_on_allowed_method", methods: []string{"LOCK"}, method: "LOCK", wantKey: true},
+		{name: "must_skip_post_not_allowed", methods: []string{"LOCK"}, method: http.MethodPost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				got = r.Header.Get("Idempotency-Key")
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+			})
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.key != "" {
+				r.Header.Set("Idempotency-Key", tt.key)
+			}
+			if _, err := IdempotencyKey(UUIDv4, tt.methods...)(tripper).RoundTrip(r); err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+
+			if gotKey := (got != ""); gotKey != tt.wantKey {
+				t.Errorf("got key '%v', want key %v", got, tt.wantKey)
+			}
+			if tt.key != "" && got != tt.key {
+				t.Errorf("got key '%v', want '%v'", got, tt.key)
+			}
+			if r.Header.Get("Idempotency-Key") != tt.key {
+				t.Errorf("got caller's request modified, want unchanged")
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey_Retry(t *testing.T) {
+	var keys []string
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+	})
+
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(0)}
+	client := IdempotencyKey(UUIDv7)(Retry(policy)(tripper))
+	if _, err := client.RoundTrip(httptest.NewRequest(http.MethodPost, "/", nil)); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	if len(keys) != 3 {
+		t.Fatalf("got %v tries, want 3", len(keys))
+	}
+	for _, k := range keys {
+		if k == "" || k != keys[0] {
+			t.Errorf("got keys %v, want one key on every try", keys)
+			break
+		}
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		version UUIDVersion
+		pattern string
+	}{
+		{
+			name:    "must_format_v4",
+			version: UUIDv4,
+			pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		},
+		{
+			name:    "must_format_v7_with_timestamp",
+			version: UUIDv7,
+			pattern: `^01941f29-7c00-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newUUID(tt.version, now), newUUID(tt.version, now)
+			if !regexp.MustCompile(tt.pattern).MatchString(a) {
+				t.Errorf("got '%v', want match of '%v'", a, tt.pattern)
+			}
+			if a == b {
+				t.Errorf("got equal UUIDs '%v', want distinct", a)
+			}
+		})
+	}
+}
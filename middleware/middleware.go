@@ -4,15 +4,20 @@
 package middleware
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/rand/v2"
+	"math"
 	"net/http"
+	"net/http/httptrace"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -99,8 +104,15 @@ type RoundTripperFunc func(*http.Request) (*http.Response, error)
 func (fn RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return fn(r) }
 
 // RequestLogger returns middleware that logs request and response round trips.
-// Logged fields include remote address, method, URL, protocol, response status,
-// user agent, and time to return (here as ttr).
+// Logged fields include method, URL, protocol, response status, response
+// content length, user agent, and time to return (here as ttr). The remote
+// address is logged if the transport reports it through httptrace, the
+// attempt number if RequestLogger is placed inside Retry, the phases of the
+// round trip if it is traced by Timing, and the CacheStatus if RequestLogger
+// is placed outside Cache.
+//
+// Round trips that return an error are logged at Error level with the error
+// and its ErrorClass in place of the response fields.
 //
 // If logger is nil, slog.Default() is used.
 func RequestLogger(logger *slog.Logger, prefix string) func(http.RoundTripper) http.RoundTripper {
@@ -110,20 +122,59 @@ func RequestLogger(logger *slog.Logger, prefix string) func(http.RoundTripper) h
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			var remote atomic.Value
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) { remote.Store(info.Conn.RemoteAddr().String()) },
+			}
+
 			start := time.Now().UTC()
-			resp, err := next.RoundTrip(r)
+			resp, err := next.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
 			duration := time.Since(start)
 
-			logger.Info(
-				prefix,
+			attrs := []slog.Attr{
 				slog.String("method", r.Method),
 				slog.String("dest", r.URL.String()),
 				slog.String("proto", r.Proto),
-				slog.Int("status", resp.StatusCode),
+			}
+			if addr, ok := remote.Load().(string); ok {
+				attrs = append(attrs, slog.String("remote", addr))
+			}
+			if attempt, ok := RetryAttempt(r.Context()); ok {
+				attrs = append(attrs, slog.Uint64("attempt", uint64(attempt)))
+			}
+
+			level := slog.LevelInfo
+			if err != nil {
+				level = slog.LevelError
+				attrs = append(attrs,
+					slog.String("error", err.Error()),
+					slog.String("class", string(ClassifyError(err))),
+				)
+			} else if resp != nil {
+				attrs = append(attrs,
+					slog.Int("status", resp.StatusCode),
+					slog.Int64("length", resp.ContentLength),
+				)
+			}
+			attrs = append(attrs,
 				slog.String("user-agent", r.UserAgent()),
 				slog.Duration("ttr", duration),
 			)
 
+			// timings and cache status are recorded inside or outside of here
+			ctx := r.Context()
+			if resp != nil && resp.Request != nil {
+				ctx = resp.Request.Context()
+			}
+			if timings, ok := TimingsFromContext(ctx); ok {
+				attrs = append(attrs, timings.attrs()...)
+			}
+			if status, ok := CacheStatusFromContext(ctx); ok {
+				attrs = append(attrs, slog.String("cache", string(status)))
+			}
+
+			logger.LogAttrs(r.Context(), level, prefix, attrs...)
+
 			return resp, err
 		})
 	}
@@ -144,20 +195,59 @@ type CircuitBreaker struct {
 	threshold uint
 	cooldown  time.Duration
 	showtime  time.Time
+	clock     Clock
 
 	state BreakerState
 	mutex sync.Mutex
 }
 
+// breakerOptions holds the optional configuration of a CircuitBreaker.
+type breakerOptions struct {
+	clock Clock
+}
+
+// BreakerOption is a function that sets a CircuitBreaker option.
+type BreakerOption func(*breakerOptions)
+
+// WithBreakerClock sets CircuitBreaker to tell time using clock.
+func WithBreakerClock(clock Clock) BreakerOption {
+	return func(o *breakerOptions) { o.clock = clock }
+}
+
+// newBreakerOptions returns the configuration set by opts over the defaults.
+func newBreakerOptions(opts []BreakerOption) breakerOptions {
+	o := breakerOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clock == nil {
+		o.clock = SystemClock{}
+	}
+	return o
+}
+
 // NewCircuitBreaker returns a new CircuitBreaker. It is initialized with a
 // threshold and open cooldown time that cannot be changed. By default,
 // the breaker is in the closed state and showtime is set to the current time.
-func NewCircuitBreaker(threshold uint, cooldown time.Duration) *CircuitBreaker {
-	return &CircuitBreaker{
+// If no clock option is supplied, SystemClock is used.
+func NewCircuitBreaker(threshold uint, cooldown time.Duration, opts ...BreakerOption) *CircuitBreaker {
+	breaker := &CircuitBreaker{
 		threshold: threshold,
 		cooldown:  cooldown,
-		showtime:  time.Now().UTC(),
+		clock:     newBreakerOptions(opts).clock,
+	}
+
+	breaker.showtime = breaker.now()
+
+	return breaker
+}
+
+// now returns the current UTC time according to the breaker's clock.
+func (breaker *CircuitBreaker) now() time.Time {
+	if breaker.clock == nil {
+		return time.Now().UTC()
 	}
+	return breaker.clock.Now().UTC()
 }
 
 // State returns the current breaker's state. If open and past showtime, the
@@ -166,7 +256,7 @@ func (breaker *CircuitBreaker) State() BreakerState {
 	breaker.mutex.Lock()
 	defer breaker.mutex.Unlock()
 
-	if (breaker.state == BreakerStateOpen) && time.Now().UTC().After(breaker.showtime) {
+	if (breaker.state == BreakerStateOpen) && breaker.now().After(breaker.showtime) {
 		breaker.state = BreakerStateClosed
 	}
 
@@ -176,6 +266,14 @@ func (breaker *CircuitBreaker) State() BreakerState {
 // OK returns whether the circuit is closed and therefore ok.
 func (breaker *CircuitBreaker) OK() bool { return breaker.State() == BreakerStateClosed }
 
+// Showtime returns the time at which an open breaker flips closed again.
+func (breaker *CircuitBreaker) Showtime() time.Time {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return breaker.showtime
+}
+
 // OnSuccess resets failures to zero.
 func (breaker *CircuitBreaker) OnSuccess() {
 	breaker.mutex.Lock()
@@ -194,14 +292,78 @@ func (breaker *CircuitBreaker) OnFailure() {
 
 	if breaker.failures > breaker.threshold {
 
-		breaker.showtime = time.Now().UTC().Add(breaker.cooldown)
+		breaker.showtime = breaker.now().Add(breaker.cooldown)
 		breaker.state = BreakerStateOpen
 		breaker.failures = 0
 	}
 }
 
+// IsHandlerFailure reports whether a handler outcome counts as a failure:
+// a 5xx response status, or a request context whose deadline was exceeded.
+// It is used if no classifier is supplied to ShedOnBreak.
+func IsHandlerFailure(r *http.Request, status int) bool {
+	return status >= http.StatusInternalServerError || errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+// ShedOnBreak returns middleware that guards handlers with breaker. Each
+// handler outcome is classified by failed and reported to breaker. While the
+// breaker is open, requests are answered immediately with 503 Service
+// Unavailable and a Retry-After header field set to the breaker's showtime,
+// without calling the handler.
+//
+// A handler that panics counts as a failure; the panic is left to propagate.
+//
+// If failed is nil, IsHandlerFailure is used. If breaker is nil, requests
+// pass through to handlers unguarded.
+func ShedOnBreak(breaker *CircuitBreaker, failed func(r *http.Request, status int) bool) func(h http.Handler) http.Handler {
+	if failed == nil {
+		failed = IsHandlerFailure
+	}
+
+	return func(h http.Handler) http.Handler {
+		if breaker == nil {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !breaker.OK() {
+				wait := breaker.Showtime().Sub(breaker.now())
+				secs := max(int64((wait+time.Second-1)/time.Second), 1)
+
+				w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+
+			rw := &captureWriter{ResponseWriter: w}
+			returned := false
+			defer func() {
+				// the handler panicked
+				if !returned {
+					breaker.OnFailure()
+				}
+			}()
+			h.ServeHTTP(rw, r)
+			returned = true
+
+			// a handler that never called WriteHeader responded 200
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			if failed(r, status) {
+				breaker.OnFailure()
+			} else {
+				breaker.OnSuccess()
+			}
+		})
+	}
+}
+
 // RetryObserver is the interface implemented by an object that can observe
-// retry behavior in a RetryAndObserve RoundTripper.
+// retry behavior in a RetryAndObserve RoundTripper. Observers wanting more
+// detail may also implement RetryEventObserver or RetryBudgetObserver.
 type RetryObserver interface {
 	OnTry(*http.Request, uint)
 	OnSuccess(*http.Request, uint)
@@ -216,60 +378,397 @@ func (o *NopRetryObserver) OnTry(*http.Request, uint)            {}
 func (o *NopRetryObserver) OnSuccess(*http.Request, uint)        {}
 func (o *NopRetryObserver) OnFailure(*http.Request, uint, error) {}
 
-func RetryAndObserve(tries uint, delayBase time.Duration, delayMax time.Duration, breaker *CircuitBreaker, observer RetryObserver) func(http.RoundTripper) http.RoundTripper {
-	if observer == nil {
-		observer = &NopRetryObserver{}
+// retryOptions holds the optional configuration of a Retry RoundTripper.
+type retryOptions struct {
+	clock      Clock
+	jitter     JitterSource
+	classifier Classifier
+	breaker    *CircuitBreaker
+	observer   RetryObserver
+	bodyLimit  int64
+	budget     *RetryBudget
+
+	retryAfterLimit time.Duration
+	retryAfterAbort bool
+
+	deadlineShrink  bool
+	deadlineReserve time.Duration
+
+	attemptTimeout time.Duration
+}
+
+// RetryOption is a function that sets a Retry option.
+type RetryOption func(*retryOptions)
+
+// WithRetryClock sets Retry to tell time and wait using clock.
+func WithRetryClock(clock Clock) RetryOption {
+	return func(o *retryOptions) { o.clock = clock }
+}
+
+// WithRetryJitter sets Retry to draw backoff jitter from src.
+func WithRetryJitter(src JitterSource) RetryOption {
+	return func(o *retryOptions) { o.jitter = src }
+}
+
+// WithRetryClassifier sets Retry to decide which outcomes are retried and
+// which count as breaker failures using classifier.
+func WithRetryClassifier(classifier Classifier) RetryOption {
+	return func(o *retryOptions) { o.classifier = classifier }
+}
+
+// WithRetryBreaker sets Retry to consult breaker before and inform it after
+// the round trips.
+func WithRetryBreaker(breaker *CircuitBreaker) RetryOption {
+	return func(o *retryOptions) { o.breaker = breaker }
+}
+
+// WithRetryObserver sets Retry to report its behavior to observer.
+func WithRetryObserver(observer RetryObserver) RetryOption {
+	return func(o *retryOptions) { o.observer = observer }
+}
+
+// WithRetryBodyBuffer sets Retry to buffer up to limit bytes of request
+// bodies that lack GetBody so that they can be replayed. Larger bodies are
+// still sent once, but are not retried.
+func WithRetryBodyBuffer(limit int64) RetryOption {
+	return func(o *retryOptions) { o.bodyLimit = limit }
+}
+
+// WithRetryBudget sets Retry to deposit successful requests into budget and
+// to withdraw from it before every retry. Retries denied by the budget are
+// not made and are reported to observers implementing RetryBudgetObserver.
+func WithRetryBudget(budget *RetryBudget) RetryOption {
+	return func(o *retryOptions) { o.budget = budget }
+}
+
+// DefaultRetryAfterLimit caps the waits requested by the server if no
+// WithRetryAfterLimit option is supplied to Retry.
+const DefaultRetryAfterLimit = time.Minute
+
+// WithRetryAfterLimit sets Retry to cap waits requested by the server, through
+// Retry-After, RateLimit-Reset or X-RateLimit-Reset header fields, to limit.
+// If abort is true, Retry instead returns the last outcome without waiting
+// when the requested wait exceeds limit. A limit of 0 means no cap.
+func WithRetryAfterLimit(limit time.Duration, abort bool) RetryOption {
+	return func(o *retryOptions) {
+		o.retryAfterLimit = limit
+		o.retryAfterAbort = abort
+	}
+}
+
+// WithRetryDeadlineShrink sets Retry to shrink a wait that would leave too
+// little of the context deadline for the next try, so that one last try still
+// fits. The last try is expected to take the longer of reserve and the
+// duration of the try before it.
+func WithRetryDeadlineShrink(reserve time.Duration) RetryOption {
+	return func(o *retryOptions) {
+		o.deadlineShrink = true
+		o.deadlineReserve = reserve
+	}
+}
+
+// WithRetryAttemptTimeout sets Retry to give every try its own context that
+// times out after timeout, while the request context still bounds all tries
+// together. A try that times out is always retried, if tries remain, and is
+// reported to observers implementing RetryTimeoutObserver. The timer runs on
+// real time, not the Retry clock. A timeout of 0 means no per-try timeout.
+func WithRetryAttemptTimeout(timeout time.Duration) RetryOption {
+	return func(o *retryOptions) { o.attemptTimeout = timeout }
+}
+
+// RetryPolicy describes when and how a Retry RoundTripper retries. A policy
+// holds no per-request state, so one policy may be shared by many
+// RoundTrippers.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// Zero is treated as 1.
+	MaxAttempts uint
+
+	// ShouldRetry reports whether an attempt's outcome should be retried.
+	// If nil, the Retryable method of the Retry classifier is used.
+	ShouldRetry func(resp *http.Response, err error, attempt uint) bool
+
+	// Backoff chooses the delay before the next attempt when the response
+	// carries no Retry-After header field. If nil, DefaultBackoff is used.
+	Backoff Backoff
+
+	// MaxElapsed, if positive, stops retrying once the next attempt would
+	// start more than MaxElapsed after the first.
+	MaxElapsed time.Duration
+}
+
+// Validate returns an error if MaxElapsed is negative or if Backoff has a
+// Validate method that returns one.
+func (policy RetryPolicy) Validate() error {
+	if policy.MaxElapsed < 0 {
+		return fmt.Errorf("invalid retry policy: max elapsed %v is negative", policy.MaxElapsed)
+	}
+
+	if v, ok := policy.Backoff.(interface{ Validate() error }); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+// Retry returns middleware that retries failed round trips as described by
+// policy. Only idempotent requests, and requests that failed before any of
+// them was sent, are retried, each attempt with a fresh body from the
+// request's GetBody. If a retry is due but the body cannot be replayed, the
+// round trip fails with ErrBodyNotReplayable rather than resend an empty or
+// partial body. If the next try would not finish before the context deadline,
+// the last outcome is returned without waiting. Only an error is wrapped, with
+// ErrRetryDeadline; a response is returned as is, and the reason is only
+// reported to a RetryEventObserver, as RetryDecisionDeadline. If a breaker is
+// supplied, it is consulted before and informed after the round trips: a
+// final outcome the classifier counts as a failure is reported as such, and
+// an accepted response that is not is reported as a success.
+//
+// Waits requested by the server are capped to DefaultRetryAfterLimit, so that
+// an upstream cannot hold the caller for as long as it likes, unless opts
+// include WithRetryAfterLimit.
+//
+// If no clock, jitter, classifier or observer options are supplied, or they
+// are nil, SystemClock, the math/rand/v2 top-level functions,
+// DefaultClassifier and NopRetryObserver are used.
+func Retry(policy RetryPolicy, opts ...RetryOption) func(http.RoundTripper) http.RoundTripper {
+	o := retryOptions{clock: SystemClock{}, jitter: globalJitter{}, classifier: DefaultClassifier{}, retryAfterLimit: DefaultRetryAfterLimit}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.clock == nil {
+		o.clock = SystemClock{}
+	}
+	if o.jitter == nil {
+		o.jitter = globalJitter{}
+	}
+	if o.classifier == nil {
+		o.classifier = DefaultClassifier{}
+	}
+	if o.observer == nil {
+		o.observer = &NopRetryObserver{}
+	}
+
+	tries := max(policy.MaxAttempts, 1)
+
+	shouldRetry := policy.ShouldRetry
+	if shouldRetry == nil {
+		shouldRetry = func(resp *http.Response, err error, _ uint) bool { return o.classifier.Retryable(resp, err) }
 	}
 
+	backoff := policy.Backoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+
+	breaker, observer := o.breaker, o.observer
+	events, _ := observer.(RetryEventObserver)
+
 	return func(next http.RoundTripper) http.RoundTripper {
 		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
 			if breaker != nil && !breaker.OK() {
-				return nil, fmt.Errorf("circuit open: waiting until %v", breaker.showtime)
+				return nil, fmt.Errorf("circuit open: waiting until %v", breaker.Showtime())
+			}
+
+			body, getBody, err := rewindBody(r, o.bodyLimit)
+			if err != nil {
+				return nil, err
 			}
 
-			var err error
 			var resp *http.Response
+			var wait time.Duration
+
+			start := o.clock.Now()
+
+			// whether the last try ran out of its own timeout
+			var timedOut bool
+
+			// report each outcome to observers wanting the details
+			emit := func(i uint, resp *http.Response, err error, decision RetryDecision) {
+				if events == nil {
+					return
+				}
+				event := RetryEvent{Request: r, Attempt: i, Err: err, TimedOut: timedOut, Elapsed: o.clock.Now().Sub(start), Decision: decision}
+				if resp != nil {
+					event.Status = resp.StatusCode
+				}
+				if decision == RetryDecisionRetry {
+					event.Delay = wait
+				}
+				events.OnRetryEvent(event)
+			}
 
 			var i uint
 			for i = 1; i <= tries; i++ {
 				observer.OnTry(r, i)
 
-				// request must be cloned
-				req := r.Clone(r.Context())
+				// give each try its own timeout, if any
+				ctx, cancel := r.Context(), context.CancelFunc(func() {})
+				if o.attemptTimeout > 0 {
+					ctx, cancel = context.WithTimeout(ctx, o.attemptTimeout)
+				}
+
+				// request must be cloned, and traced to learn if it was sent
+				var traced, wrote atomic.Bool
+				ctx = context.WithValue(ctx, attemptKey{}, i)
+				req := r.Clone(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+					GetConn:          func(string) { traced.Store(true) },
+					WroteHeaderField: func(string, []string) { wrote.Store(true) },
+				}))
+				req.Body = body
+				tryStart := o.clock.Now()
 				resp, err = next.RoundTrip(req)
+				took := o.clock.Now().Sub(tryStart)
+
+				// keep the try's context alive until its body is closed
+				if o.attemptTimeout > 0 && resp != nil && resp.Body != nil {
+					resp.Body = &releaseBody{ReadCloser: resp.Body, release: cancel}
+				} else {
+					cancel()
+				}
+
+				// tell a timed out try from a done request
+				timedOut = err != nil && ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil
+				if timedOut {
+					err = fmt.Errorf("%w: %w", ErrAttemptTimeout, err)
+					if obs, ok := observer.(RetryTimeoutObserver); ok {
+						obs.OnAttemptTimeout(r, i)
+					}
+				}
+
+				// mark errors of tries that never wrote the request
+				if err != nil && traced.Load() && !wrote.Load() {
+					err = &notSentError{err: err}
+				}
+
+				retryable := timedOut || shouldRetry(resp, err, i)
 
 				// return on acceptable response
-				if err == nil && resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+				if err == nil && !retryable {
 					if breaker != nil {
-						breaker.OnSuccess()
+						if o.classifier.Failure(resp, err) {
+							breaker.OnFailure()
+						} else {
+							breaker.OnSuccess()
+						}
 					}
+					if o.budget != nil {
+						o.budget.Deposit()
+					}
+					emit(i, resp, err, RetryDecisionAccept)
 					observer.OnSuccess(req, i)
 					return resp, nil
 				}
 
-				// skip retries if request is not idempotent
+				// skip retries if outcome is not retryable
+				if !retryable {
+					emit(i, resp, err, RetryDecisionNotRetryable)
+					break
+				}
+
+				// skip retries if request is not idempotent and may have been sent
+				if !isIdempotent(req) && !errors.Is(err, ErrNotSent) {
+					emit(i, resp, err, RetryDecisionNotIdempotent)
+					break
+				}
+
 				// skip body discard if last try
-				if !isIdempotent(req) || i == tries {
+				if i == tries {
+					emit(i, resp, err, RetryDecisionExhausted)
+					break
+				}
+
+				var requested bool
+				wait, requested = delay(resp, backoff, i, wait, o.clock.Now(), o.jitter)
+
+				// cap waits requested by the server, or give up on them
+				if requested && o.retryAfterLimit > 0 && wait > o.retryAfterLimit {
+					if o.retryAfterAbort {
+						emit(i, resp, err, RetryDecisionRetryAfterExceeded)
+						break
+					}
+					wait = o.retryAfterLimit
+				}
+
+				// skip retries if next try would start past max elapsed, without
+				// adding to a wait that may be near the largest duration
+				if policy.MaxElapsed > 0 && wait > policy.MaxElapsed-o.clock.Now().Sub(start) {
+					emit(i, resp, err, RetryDecisionMaxElapsed)
+					break
+				}
+
+				// skip retries if next try would not finish before the deadline
+				if deadline, ok := r.Context().Deadline(); ok {
+					need := max(took, o.deadlineReserve)
+					left := deadline.Sub(o.clock.Now())
+					if need > left || wait > left-need {
+						if !o.deadlineShrink || need > left {
+							emit(i, resp, err, RetryDecisionDeadline)
+							if err != nil {
+								err = fmt.Errorf("%w: last try got error: %w", ErrRetryDeadline, err)
+							}
+							break
+						}
+						wait = left - need
+					}
+				}
+
+				// fail rather than resend an empty or partial body
+				if getBody == nil {
+					emit(i, resp, err, RetryDecisionBodyNotReplayable)
+					if resp != nil {
+						resp.Body.Close()
+					}
+					if err == nil {
+						err = fmt.Errorf("%w: last try got status %d", ErrBodyNotReplayable, resp.StatusCode)
+					} else {
+						err = fmt.Errorf("%w: last try got error: %w", ErrBodyNotReplayable, err)
+					}
+					resp = nil
 					break
 				}
 
-				// only reached on err, resp.StatusCode > 500 or resp.StatusCode == 429
+				// skip retries if budget is exhausted
+				if o.budget != nil && !o.budget.Withdraw() {
+					emit(i, resp, err, RetryDecisionBudgetDenied)
+					if obs, ok := observer.(RetryBudgetObserver); ok {
+						obs.OnRetryDenied(r, i)
+					}
+					break
+				}
+
+				// request body must be fresh for every try
+				fresh, bodyErr := getBody()
+				if bodyErr != nil {
+					if resp != nil {
+						resp.Body.Close()
+					}
+					err = fmt.Errorf("%w: %w", ErrBodyNotReplayable, bodyErr)
+					resp = nil
+					emit(i, resp, err, RetryDecisionBodyNotReplayable)
+					break
+				}
+				body = fresh
+
+				emit(i, resp, err, RetryDecisionRetry)
+
+				// only reached on retryable outcomes
 				if resp != nil { // reset response body to prep for next try
 					io.Copy(io.Discard, resp.Body)
 					resp.Body.Close()
 				}
 
-				delay := delay(resp, delayBase, delayMax, i)
-
 				// and consider context
 				select {
-				case <-time.After(delay):
-				case <-req.Context().Done():
-					return nil, req.Context().Err()
+				case <-o.clock.After(wait):
+				case <-r.Context().Done():
+					emit(i, nil, r.Context().Err(), RetryDecisionCanceled)
+					return nil, r.Context().Err()
 				}
 			}
 
-			if breaker != nil {
+			if breaker != nil && o.classifier.Failure(resp, err) {
 				breaker.OnFailure()
 			}
 			observer.OnFailure(r, i, err)
@@ -279,6 +778,34 @@ func RetryAndObserve(tries uint, delayBase time.Duration, delayMax time.Duration
 	}
 }
 
+// attemptKey is the context key under which Retry stores the number of a try.
+type attemptKey struct{}
+
+// RetryAttempt returns the number of the Retry try, starting at 1, that made
+// the request with context ctx, and whether there is one.
+func RetryAttempt(ctx context.Context) (uint, bool) {
+	i, ok := ctx.Value(attemptKey{}).(uint)
+	return i, ok
+}
+
+// RetryAndObserve returns middleware that retries failed round trips up to
+// tries times with exponential backoff between delayBase and delayMax. It is
+// shorthand for Retry with a RetryPolicy of tries attempts and an
+// ExponentialBackoff, and with breaker and observer options. Waits requested
+// by the server are capped to delayMax, unless opts include
+// WithRetryAfterLimit.
+//
+// If observer is nil, NopRetryObserver is used.
+func RetryAndObserve(tries uint, delayBase time.Duration, delayMax time.Duration, breaker *CircuitBreaker, observer RetryObserver, opts ...RetryOption) func(http.RoundTripper) http.RoundTripper {
+	policy := RetryPolicy{
+		MaxAttempts: tries,
+		Backoff:     ExponentialBackoff{Base: delayBase, Max: delayMax},
+	}
+
+	defaults := []RetryOption{WithRetryBreaker(breaker), WithRetryObserver(observer), WithRetryAfterLimit(delayMax, false)}
+	return Retry(policy, append(defaults, opts...)...)
+}
+
 // isIdempotent returns true if any of the following apply:
 //   - r.Method is canonically idempotent: GET, HEAD, OPTIONS, TRACE, PUT, or DELETE
 //   - r.Header contains a non-empty header field "Idempotency-Key".
@@ -301,44 +828,126 @@ func isIdempotent(r *http.Request) bool {
 	return false
 }
 
+// ErrRetryDeadline wraps the last error of a Retry RoundTripper that gave up
+// because the next try would not finish before the context deadline. A last
+// response is returned unwrapped.
+var ErrRetryDeadline = errors.New("retry would exceed context deadline")
+
+// ErrAttemptTimeout wraps the error of a Retry try that exceeded the timeout
+// set with WithRetryAttemptTimeout.
+var ErrAttemptTimeout = errors.New("retry attempt timed out")
+
+// RetryTimeoutObserver is the interface implemented by a RetryObserver that
+// wants to know when a try exceeds the timeout set with
+// WithRetryAttemptTimeout. It is detected with a type assertion, so existing
+// observers need not implement it.
+type RetryTimeoutObserver interface {
+	OnAttemptTimeout(*http.Request, uint)
+}
+
+// ErrBodyNotReplayable is returned by a Retry RoundTripper when a retry is due
+// but the request body cannot be sent again.
+var ErrBodyNotReplayable = errors.New("request body not replayable")
+
+// readCloser combines a Reader and a Closer into an io.ReadCloser.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rewindBody returns the body for the first try of r and a function that
+// returns a fresh copy of it for later tries. A request without a body can
+// always be replayed. Otherwise r.GetBody is used if present. If not, and
+// limit is positive, up to limit bytes of the body are buffered. getBody is
+// nil if the body cannot be replayed.
+func rewindBody(r *http.Request, limit int64) (body io.ReadCloser, getBody func() (io.ReadCloser, error), err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r.Body, func() (io.ReadCloser, error) { return r.Body, nil }, nil
+	}
+
+	if r.GetBody != nil {
+		return r.Body, r.GetBody, nil
+	}
+
+	if limit <= 0 {
+		return r.Body, nil, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, nil, err
+	}
+
+	// too large to buffer: send once, then give up on replay
+	if int64(len(buf)) > limit {
+		return readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}, nil, nil
+	}
+
+	r.Body.Close()
+	getBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(buf)), nil }
+	body, _ = getBody()
+
+	return body, getBody, nil
+}
+
+// unixResetThreshold separates X-RateLimit-Reset values given in delta
+// seconds from those given as Unix timestamps, which some servers send.
+const unixResetThreshold = 1_000_000_000
+
 // retryAfterValue returns time.Duration value, if any, from header key
-// "Retry-After" in h.
-func retryAfterValue(h http.Header) (time.Duration, bool) {
-	v := h.Get("Retry-After")
-	if v == "" {
-		return 0, false
+// "Retry-After" in h, or else from "RateLimit-Reset" or "X-RateLimit-Reset".
+// HTTP-date and Unix timestamp values are measured relative to now. Values in
+// the past are clamped to zero.
+func retryAfterValue(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return seconds(secs), true
+		}
+
+		if t, err := http.ParseTime(v); err == nil {
+			return max(t.Sub(now), 0), true
+		}
 	}
 
-	if secs, err := strconv.Atoi(v); err == nil {
-		return time.Duration(secs) * time.Second, true
+	if v := h.Get("RateLimit-Reset"); v != "" {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return seconds(secs), true
+		}
 	}
 
-	if t, err := http.ParseTime(v); err == nil {
-		return time.Until(t), true
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			if secs >= unixResetThreshold {
+				return max(time.Unix(secs, 0).Sub(now), 0), true
+			}
+			return seconds(secs), true
+		}
 	}
 
 	return 0, false
 }
 
+// seconds returns secs as a time.Duration, clamped to zero and to the
+// largest representable duration.
+func seconds(secs int64) time.Duration {
+	if secs > int64(math.MaxInt64/time.Second) {
+		return math.MaxInt64
+	}
+	return max(time.Duration(secs)*time.Second, 0)
+}
+
 // delay returns an appropriate delay based on the current circumstaces.
-// If a Retry-After header field value is present in the response, that is
-// returned without further processing. Otherwise this returns an exponential
-// backoff of base (clamped to max) with random jitter +-10% to prevent
-// simultaneous retries. This will panic if base = 0, max = 0, or count = 0.
-func delay(resp *http.Response, base time.Duration, max time.Duration, count uint) time.Duration {
+// If a Retry-After, or rate limit reset, header field value is present in the
+// response, that is returned without further processing and requested is
+// true. Otherwise this returns the delay chosen by backoff for count, given
+// the previous delay prev.
+func delay(resp *http.Response, backoff Backoff, count uint, prev time.Duration, now time.Time, jitter JitterSource) (d time.Duration, requested bool) {
 	if resp != nil {
-		if d, ok := retryAfterValue(resp.Header); ok {
-			return d
+		if d, ok := retryAfterValue(resp.Header, now); ok {
+			return d, true
 		}
 	}
 
-	d := time.Duration(1<<(count-1)) * base
-	if d > max {
-		d = max
-	}
-
-	// -10%...+10%
-	jitter := time.Duration(rand.Int64N(int64(d/5))) - d/10
-
-	return d + jitter
+	return backoff.Delay(count, prev, jitter), false
 }
@@ -4,17 +4,22 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
 )
 
 func TestCaptureWriter_WriteHeader(t *testing.T) {
@@ -234,6 +239,62 @@ func TestRequestLogger(t *testing.T) {
 	}
 }
 
+func TestRequestLogger_Error(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("dial: %w", context.Canceled)
+	})
+
+	resp, err := RequestLogger(logger, "")(tripper).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp != nil || err == nil {
+		t.Fatalf("got response %v and error %v, want nil and error", resp, err)
+	}
+
+	got := buf.String()
+	for _, sub := range []string{"level=ERROR", `error="dial: context canceled"`, "class=canceled", "ttr="} {
+		if !strings.Contains(got, sub) {
+			t.Errorf("'%s' does not contain '%s'", got, sub)
+		}
+	}
+	if strings.Contains(got, "status=") {
+		t.Errorf("'%s' contains 'status=', want none on error", got)
+	}
+}
+
+func TestRequestLogger_Transport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	policy := RetryPolicy{MaxAttempts: 2}
+	client := &http.Client{Transport: Retry(policy)(RequestLogger(logger, "")(server.Client().Transport))}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	resp.Body.Close()
+
+	got := buf.String()
+	want := []string{
+		"level=INFO",
+		"remote=" + server.Listener.Addr().String(),
+		"attempt=1",
+		"status=200",
+		"length=2",
+	}
+	for _, sub := range want {
+		if !strings.Contains(got, sub) {
+			t.Errorf("'%s' does not contain '%s'", got, sub)
+		}
+	}
+}
+
 func TestNewCircuitBreaker(t *testing.T) {
 	var threshold uint = 5
 	cooldown := time.Minute
@@ -257,6 +318,31 @@ func TestNewCircuitBreaker(t *testing.T) {
 	}
 }
 
+func TestWithBreakerClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := middlewaretest.NewClock(start)
+	breaker := NewCircuitBreaker(0, time.Minute, WithBreakerClock(clock))
+
+	if !breaker.showtime.Equal(start) {
+		t.Errorf("got showtime %v, want %v", breaker.showtime, start)
+	}
+
+	breaker.OnFailure()
+	if got := breaker.State(); got != BreakerStateOpen {
+		t.Fatalf("got state %v, want %v", got, BreakerStateOpen)
+	}
+
+	clock.Advance(time.Minute)
+	if got := breaker.State(); got != BreakerStateOpen {
+		t.Errorf("got state %v at showtime, want %v", got, BreakerStateOpen)
+	}
+
+	clock.Advance(time.Nanosecond)
+	if got := breaker.State(); got != BreakerStateClosed {
+		t.Errorf("got state %v past showtime, want %v", got, BreakerStateClosed)
+	}
+}
+
 func TestCircuitBreaker_State(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -392,6 +478,135 @@ func TestCircuitBreaker_OnFailure(t *testing.T) {
 	}
 }
 
+func TestShedOnBreak(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	expired, cancel := context.WithDeadline(context.Background(), start)
+	defer cancel()
+
+	tests := []struct {
+		name          string
+		open          bool
+		status        int
+		ctx           context.Context
+		failed        func(*http.Request, int) bool
+		wantCalled    bool
+		wantStatus    int
+		wantRetry     string
+		wantBreakOpen bool
+	}{
+		{
+			name:       "must_call_handler_and_stay_closed_on_success",
+			status:     http.StatusOK,
+			wantCalled: true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "must_call_handler_and_stay_closed_on_status_lt_500",
+			status:     http.StatusNotFound,
+			wantCalled: true,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:          "must_break_open_on_status_gte_500",
+			status:        http.StatusBadGateway,
+			wantCalled:    true,
+			wantStatus:    http.StatusBadGateway,
+			wantBreakOpen: true,
+		},
+		{
+			name:          "must_break_open_on_deadline_exceeded",
+			status:        http.StatusOK,
+			ctx:           expired,
+			wantCalled:    true,
+			wantStatus:    http.StatusOK,
+			wantBreakOpen: true,
+		},
+		{
+			name:          "must_use_supplied_classifier",
+			status:        http.StatusConflict,
+			failed:        func(_ *http.Request, status int) bool { return status == http.StatusConflict },
+			wantCalled:    true,
+			wantStatus:    http.StatusConflict,
+			wantBreakOpen: true,
+		},
+		{
+			name:          "must_shed_with_retry_after_on_open",
+			open:          true,
+			wantStatus:    http.StatusServiceUnavailable,
+			wantRetry:     "90",
+			wantBreakOpen: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(start)
+			breaker := NewCircuitBreaker(0, 90*time.Second, WithBreakerClock(clock))
+			if tt.open {
+				breaker.OnFailure()
+				clock.Advance(time.Second / 2)
+			}
+
+			called := false
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(tt.status)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ctx != nil {
+				r = r.WithContext(tt.ctx)
+			}
+
+			w := httptest.NewRecorder()
+			ShedOnBreak(breaker, tt.failed)(handler).ServeHTTP(w, r)
+
+			if called != tt.wantCalled {
+				t.Errorf("got handler called %v, want %v", called, tt.wantCalled)
+			}
+			if got := w.Code; got != tt.wantStatus {
+				t.Errorf("got status %v, want %v", got, tt.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetry {
+				t.Errorf("got Retry-After '%v', want '%v'", got, tt.wantRetry)
+			}
+			if got := !breaker.OK(); got != tt.wantBreakOpen {
+				t.Errorf("got breaker open %v, want %v", got, tt.wantBreakOpen)
+			}
+		})
+	}
+}
+
+func TestShedOnBreak_NilBreaker(t *testing.T) {
+	called := false
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true })
+
+	w := httptest.NewRecorder()
+	ShedOnBreak(nil, nil)(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !called {
+		t.Errorf("got handler called %v, want %v", called, true)
+	}
+}
+
+func TestShedOnBreak_Panic(t *testing.T) {
+	breaker := NewCircuitBreaker(0, time.Minute)
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("boom") })
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("got panic %v, want %v", p, "boom")
+			}
+		}()
+		ShedOnBreak(breaker, nil)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	if breaker.OK() {
+		t.Errorf("got breaker open %v, want %v", false, true)
+	}
+}
+
 func TestIsIdempotent(t *testing.T) {
 	tests := []struct {
 		name              string
@@ -519,7 +734,7 @@ func TestRetryAfterValue(t *testing.T) {
 				h.Set("Retry-After", tt.value)
 			}
 
-			got, ok := retryAfterValue(h)
+			got, ok := retryAfterValue(h, time.Now())
 			if ok != tt.wantBool {
 				t.Errorf("got bool %v, want %v", ok, tt.wantBool)
 			}
@@ -530,40 +745,131 @@ func TestRetryAfterValue(t *testing.T) {
 	}
 }
 
+func TestRetryAfterValue_Hardening(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		wantDuration time.Duration
+		wantBool     bool
+	}{
+		{
+			name:         "must_clamp_negative_seconds_to_zero",
+			header:       http.Header{"Retry-After": []string{"-30"}},
+			wantDuration: 0,
+			wantBool:     true,
+		},
+		{
+			name:         "must_clamp_past_date_to_zero",
+			header:       http.Header{"Retry-After": []string{now.Add(-time.Hour).Format(http.TimeFormat)}},
+			wantDuration: 0,
+			wantBool:     true,
+		},
+		{
+			name:         "must_clamp_overflowing_seconds",
+			header:       http.Header{"Retry-After": []string{"99999999999999"}},
+			wantDuration: math.MaxInt64,
+			wantBool:     true,
+		},
+		{
+			name:         "must_be_true_on_ratelimit_reset",
+			header:       http.Header{"Ratelimit-Reset": []string{"30"}},
+			wantDuration: 30 * time.Second,
+			wantBool:     true,
+		},
+		{
+			name:         "must_be_true_on_x_ratelimit_reset_seconds",
+			header:       http.Header{"X-Ratelimit-Reset": []string{"45"}},
+			wantDuration: 45 * time.Second,
+			wantBool:     true,
+		},
+		{
+			name:         "must_be_true_on_x_ratelimit_reset_unix_time",
+			header:       http.Header{"X-Ratelimit-Reset": []string{strconv.FormatInt(now.Add(time.Minute).Unix(), 10)}},
+			wantDuration: time.Minute,
+			wantBool:     true,
+		},
+		{
+			name:         "must_clamp_past_x_ratelimit_reset_unix_time",
+			header:       http.Header{"X-Ratelimit-Reset": []string{strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)}},
+			wantDuration: 0,
+			wantBool:     true,
+		},
+		{
+			name: "must_prefer_retry_after",
+			header: http.Header{
+				"Retry-After":     []string{"10"},
+				"Ratelimit-Reset": []string{"20"},
+			},
+			wantDuration: 10 * time.Second,
+			wantBool:     true,
+		},
+		{
+			name: "must_fall_back_on_retry_after_not_parsable",
+			header: http.Header{
+				"Retry-After":     []string{"soon"},
+				"Ratelimit-Reset": []string{"20"},
+			},
+			wantDuration: 20 * time.Second,
+			wantBool:     true,
+		},
+		{
+			name:     "must_be_false_on_ratelimit_reset_not_parsable",
+			header:   http.Header{"Ratelimit-Reset": []string{"soon"}},
+			wantBool: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfterValue(tt.header, now)
+			if ok != tt.wantBool {
+				t.Errorf("got bool %v, want %v", ok, tt.wantBool)
+			}
+			if got != tt.wantDuration {
+				t.Errorf("got duration %v, want %v", got, tt.wantDuration)
+			}
+		})
+	}
+}
+
 func TestDelay(t *testing.T) {
 	tests := []struct {
-		name      string
-		header    http.Header
-		base      time.Duration
-		max       time.Duration
-		count     uint
-		wantPanic bool
-		wantMin   time.Duration
-		wantMax   time.Duration
+		name    string
+		header  http.Header
+		base    time.Duration
+		max     time.Duration
+		count   uint
+		wantMin time.Duration
+		wantMax time.Duration
 	}{
 		{
-			name:      "must_panic_on_base_eq_zero",
-			header:    http.Header{},
-			base:      0,
-			max:       5 * time.Second,
-			count:     1,
-			wantPanic: true,
+			name:    "must_be_zero_on_base_eq_zero",
+			header:  http.Header{},
+			base:    0,
+			max:     5 * time.Second,
+			count:   1,
+			wantMin: 0,
+			wantMax: 0,
 		},
 		{
-			name:      "must_panic_on_max_eq_zero",
-			header:    http.Header{},
-			base:      1 * time.Second,
-			max:       0,
-			count:     1,
-			wantPanic: true,
+			name:    "must_be_zero_on_max_eq_zero",
+			header:  http.Header{},
+			base:    1 * time.Second,
+			max:     0,
+			count:   1,
+			wantMin: 0,
+			wantMax: 0,
 		},
 		{
-			name:      "must_panic_on_count_eq_zero",
-			header:    http.Header{},
-			base:      1 * time.Second,
-			max:       5 * time.Second,
-			count:     0,
-			wantPanic: true,
+			name:    "must_treat_count_eq_zero_as_one",
+			header:  http.Header{},
+			base:    1 * time.Second,
+			max:     5 * time.Second,
+			count:   0,
+			wantMin: 1*time.Second - (1 * time.Second / 10),
+			wantMax: 1*time.Second + (1 * time.Second / 10),
 		},
 		{
 			name:    "must_be_retry_after_value_if_parsable",
@@ -596,15 +902,9 @@ func TestDelay(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer func() {
-				if r := recover(); r == tt.wantPanic {
-					t.Errorf("did not panic as expected")
-				}
-			}()
-
 			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: tt.header}
 
-			got := delay(resp, tt.base, tt.max, tt.count)
+			got, _ := delay(resp, ExponentialBackoff{Base: tt.base, Max: tt.max}, tt.count, 0, time.Now(), globalJitter{})
 			if got < tt.wantMin || got > tt.wantMax {
 				t.Errorf("got duration %v, want > %v and < %v", got, tt.wantMin, tt.wantMax)
 			}
@@ -896,3 +1196,670 @@ func TestRetryAndObserve(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryAndObserve_Clock(t *testing.T) {
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var tries uint
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		tries++
+		status := http.StatusOK
+		if tries == 1 {
+			status = http.StatusInternalServerError
+		}
+		return &http.Response{StatusCode: status, Body: http.NoBody, Request: r}, nil
+	})
+
+	retry := RetryAndObserve(2, time.Hour, time.Hour, nil, nil, WithRetryClock(clock), WithRetryJitter(NewJitterSource(1)))(tripper)
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Errorf("RoundTripper failed %s", err.Error())
+		}
+		done <- resp
+	}()
+
+	// the retry waits on the fake clock rather than sleeping for an hour
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour + time.Hour/10)
+
+	resp := <-done
+	if tries != 2 {
+		t.Errorf("got tries %v, want 2", tries)
+	}
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("got response %v, want status %v", resp, http.StatusOK)
+	}
+}
+
+func TestRetryAndObserve_RetryAfterLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []RetryOption
+		wantWait time.Duration
+	}{
+		{name: "must_cap_retry_after_to_delay_max", wantWait: time.Second},
+		{name: "must_honor_supplied_limit", opts: []RetryOption{WithRetryAfterLimit(time.Minute, false)}, wantWait: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			var tries atomic.Int32
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if tries.Add(1) == 1 {
+					header := http.Header{"Retry-After": {"3600"}}
+					return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: header, Body: http.NoBody, Request: r}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+			})
+
+			opts := append([]RetryOption{WithRetryClock(clock)}, tt.opts...)
+			retry := RetryAndObserve(2, time.Millisecond, time.Second, nil, nil, opts...)(tripper)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+			}()
+
+			clock.BlockUntil(1)
+			clock.Advance(tt.wantWait - 1)
+			if got := tries.Load(); got != 1 {
+				t.Errorf("got %v tries before the wait elapsed, want 1", got)
+			}
+			clock.Advance(1)
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("got retry still waiting after %v, want done", tt.wantWait)
+			}
+
+			if got := tries.Load(); got != 2 {
+				t.Errorf("got %v tries, want 2", got)
+			}
+		})
+	}
+}
+
+func TestRetryAndObserve_Classifier(t *testing.T) {
+	classifier := ClassifierFuncs{
+		RetryableFunc: func(resp *http.Response, err error) bool {
+			if errors.Is(err, context.Canceled) {
+				return false
+			}
+			return DefaultClassifier{}.Retryable(resp, err)
+		},
+		FailureFunc: func(resp *http.Response, err error) bool {
+			if errors.Is(err, context.Canceled) {
+				return false
+			}
+			if resp != nil && resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "" {
+				return false
+			}
+			return DefaultClassifier{}.Failure(resp, err)
+		},
+	}
+
+	tests := []struct {
+		name          string
+		status        int
+		retryAfter    string
+		err           error
+		wantTries     uint
+		wantBreakOpen bool
+	}{
+		{
+			name:          "must_retry_and_fail_on_status_503",
+			status:        http.StatusServiceUnavailable,
+			wantTries:     3,
+			wantBreakOpen: true,
+		},
+		{
+			name:       "must_retry_but_not_fail_on_status_503_with_retry_after",
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "0",
+			wantTries:  3,
+		},
+		{
+			name:      "must_neither_retry_nor_fail_on_context_canceled",
+			err:       context.Canceled,
+			wantTries: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries uint
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tries++
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				resp := &http.Response{StatusCode: tt.status, Header: http.Header{}, Body: http.NoBody, Request: r}
+				if tt.retryAfter != "" {
+					resp.Header.Set("Retry-After", tt.retryAfter)
+				}
+				return resp, nil
+			})
+
+			breaker := NewCircuitBreaker(0, time.Minute)
+			retry := RetryAndObserve(3, time.Millisecond, time.Millisecond, breaker, nil, WithRetryClassifier(classifier))(tripper)
+			retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if tries != tt.wantTries {
+				t.Errorf("got tries %v, want %v", tries, tt.wantTries)
+			}
+			if got := !breaker.OK(); got != tt.wantBreakOpen {
+				t.Errorf("got breaker open %v, want %v", got, tt.wantBreakOpen)
+			}
+		})
+	}
+}
+
+// recordingObserver records the calls made to a RetryObserver.
+type recordingObserver struct {
+	tries     []uint
+	successes []uint
+	failures  []uint
+}
+
+func (o *recordingObserver) OnTry(_ *http.Request, i uint)     { o.tries = append(o.tries, i) }
+func (o *recordingObserver) OnSuccess(_ *http.Request, i uint) { o.successes = append(o.successes, i) }
+func (o *recordingObserver) OnFailure(_ *http.Request, i uint, _ error) {
+	o.failures = append(o.failures, i)
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        RetryPolicy
+		statuses      []int
+		wantTries     uint
+		wantStatus    int
+		wantSuccesses int
+		wantFailures  int
+	}{
+		{
+			name:         "must_try_once_on_max_attempts_zero",
+			policy:       RetryPolicy{},
+			statuses:     []int{http.StatusInternalServerError, http.StatusOK},
+			wantTries:    1,
+			wantStatus:   http.StatusInternalServerError,
+			wantFailures: 1,
+		},
+		{
+			name:          "must_use_default_backoff_on_nil",
+			policy:        RetryPolicy{MaxAttempts: 2},
+			statuses:      []int{http.StatusInternalServerError, http.StatusOK},
+			wantTries:     2,
+			wantStatus:    http.StatusOK,
+			wantSuccesses: 1,
+		},
+		{
+			name: "must_use_should_retry",
+			policy: RetryPolicy{
+				MaxAttempts: 3,
+				ShouldRetry: func(resp *http.Response, _ error, attempt uint) bool {
+					return resp.StatusCode == http.StatusConflict && attempt < 2
+				},
+				Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond},
+			},
+			statuses:      []int{http.StatusConflict, http.StatusConflict, http.StatusOK},
+			wantTries:     2,
+			wantStatus:    http.StatusConflict,
+			wantSuccesses: 1,
+		},
+		{
+			name: "must_stop_before_exceeding_max_elapsed",
+			policy: RetryPolicy{
+				MaxAttempts: 3,
+				Backoff:     ExponentialBackoff{Base: time.Minute, Max: time.Minute},
+				MaxElapsed:  30 * time.Second,
+			},
+			statuses:     []int{http.StatusInternalServerError, http.StatusOK},
+			wantTries:    1,
+			wantStatus:   http.StatusInternalServerError,
+			wantFailures: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries uint
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				status := tt.statuses[tries]
+				tries++
+				return &http.Response{StatusCode: status, Body: http.NoBody, Request: r}, nil
+			})
+
+			clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			observer := &recordingObserver{}
+			retry := Retry(tt.policy, WithRetryObserver(observer), WithRetryClock(clock))(tripper)
+
+			done := make(chan *http.Response)
+			go func() {
+				resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+				if err != nil {
+					t.Errorf("RoundTripper failed %s", err.Error())
+				}
+				done <- resp
+			}()
+
+			var resp *http.Response
+			for resp == nil {
+				select {
+				case resp = <-done:
+				case <-time.After(time.Millisecond):
+					clock.Advance(time.Minute)
+				}
+			}
+
+			if tries != tt.wantTries {
+				t.Errorf("got tries %v, want %v", tries, tt.wantTries)
+			}
+			if got := resp.StatusCode; got != tt.wantStatus {
+				t.Errorf("got status %v, want %v", got, tt.wantStatus)
+			}
+			if got := len(observer.successes); got != tt.wantSuccesses {
+				t.Errorf("got %v observed successes, want %v", got, tt.wantSuccesses)
+			}
+			if got := len(observer.failures); got != tt.wantFailures {
+				t.Errorf("got %v observed failures, want %v", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRetry_NilOptions(t *testing.T) {
+	tries := 0
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		tries++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+	})
+
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: FullJitterBackoff{Base: time.Millisecond, Max: time.Millisecond}}
+	retry := Retry(policy, WithRetryClock(nil), WithRetryJitter(nil), WithRetryClassifier(nil), WithRetryObserver(nil))(tripper)
+
+	// nil options must fall back to the defaults rather than panic
+	resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || tries != 2 {
+		t.Errorf("got status %v after %v tries, want %v after 2", resp.StatusCode, tries, http.StatusServiceUnavailable)
+	}
+}
+
+type errReader struct{}
+
+func (e errReader) Read(p []byte) (int, error) { return 0, fmt.Errorf("simulated read error") }
+
+func TestRewindBody(t *testing.T) {
+	payload := "payload"
+
+	tests := []struct {
+		name        string
+		body        io.Reader
+		getBody     bool
+		limit       int64
+		wantErr     bool
+		wantReplay  bool
+		wantBody    string
+		wantReplays string
+	}{
+		{name: "must_replay_on_body_nil", wantReplay: true},
+		{name: "must_replay_on_no_body", body: http.NoBody, wantReplay: true},
+		{name: "must_replay_on_get_body", body: strings.NewReader(payload), getBody: true, wantReplay: true, wantBody: payload, wantReplays: payload},
+		{name: "must_not_replay_on_no_get_body_and_no_limit", body: strings.NewReader(payload), wantBody: payload},
+		{name: "must_replay_on_buffered_within_limit", body: strings.NewReader(payload), limit: 7, wantReplay: true, wantBody: payload, wantReplays: payload},
+		{name: "must_not_replay_but_send_whole_on_exceeding_limit", body: strings.NewReader(payload), limit: 6, wantBody: payload},
+		{name: "must_error_on_buffer_read_error", body: errReader{}, limit: 6, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Body, r.GetBody = nil, nil
+			if tt.body != nil {
+				r.Body = io.NopCloser(tt.body)
+				if tt.body == http.NoBody {
+					r.Body = http.NoBody
+				}
+			}
+			if tt.getBody {
+				r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(payload)), nil }
+			}
+
+			body, getBody, err := rewindBody(r, tt.limit)
+			if got := (err != nil); got != tt.wantErr {
+				t.Fatalf("got error %v, want %v", got, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := (getBody != nil); got != tt.wantReplay {
+				t.Errorf("got replay %v, want %v", got, tt.wantReplay)
+			}
+			if body != nil {
+				if got, _ := io.ReadAll(body); string(got) != tt.wantBody {
+					t.Errorf("got body '%v', want '%v'", string(got), tt.wantBody)
+				}
+			}
+			if getBody != nil {
+				for range 2 {
+					replay, err := getBody()
+					if err != nil {
+						t.Fatalf("failed getBody: %s", err.Error())
+					}
+					if replay == nil {
+						continue
+					}
+					if got, _ := io.ReadAll(replay); string(got) != tt.wantReplays {
+						t.Errorf("got replayed body '%v', want '%v'", string(got), tt.wantReplays)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRetry_Body(t *testing.T) {
+	payload := "payload"
+
+	tests := []struct {
+		name      string
+		getBody   bool
+		limit     int64
+		wantTries int
+		wantErr   error
+	}{
+		{name: "must_replay_body_with_get_body", getBody: true, wantTries: 3},
+		{name: "must_replay_body_with_buffer", limit: 1024, wantTries: 3},
+		{name: "must_fail_on_body_not_replayable", wantTries: 1, wantErr: ErrBodyNotReplayable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bodies []string
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				got, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Fatalf("failed to read request body: %s", err.Error())
+				}
+				bodies = append(bodies, string(got))
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+			})
+
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Body = io.NopCloser(strings.NewReader(payload))
+			if tt.getBody {
+				r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(payload)), nil }
+			}
+
+			policy := RetryPolicy{MaxAttempts: 3, Backoff: ExponentialBackoff{Base: time.Millisecond, Max: time.Millisecond}}
+			_, err := Retry(policy, WithRetryBodyBuffer(tt.limit))(tripper).RoundTrip(r)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got := len(bodies); got != tt.wantTries {
+				t.Errorf("got tries %v, want %v", got, tt.wantTries)
+			}
+			for i, got := range bodies {
+				if got != payload {
+					t.Errorf("try %d: got body '%v', want '%v'", i+1, got, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestRetry_RetryAfterLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []RetryOption
+		wantTries int
+		wantWait  time.Duration
+	}{
+		{name: "must_cap_requested_wait", opts: []RetryOption{WithRetryAfterLimit(time.Second, false)}, wantTries: 2, wantWait: time.Second},
+		{name: "must_abort_on_requested_wait_over_limit", opts: []RetryOption{WithRetryAfterLimit(time.Second, true)}, wantTries: 1},
+		{name: "must_cap_requested_wait_by_default", wantTries: 2, wantWait: DefaultRetryAfterLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			tries := 0
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tries++
+				resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}, Body: http.NoBody, Request: r}
+				resp.Header.Set("Retry-After", "3600")
+				return resp, nil
+			})
+
+			policy := RetryPolicy{MaxAttempts: 2}
+			retry := Retry(policy, append([]RetryOption{WithRetryClock(clock)}, tt.opts...)...)(tripper)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+				if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+					t.Errorf("got response %v and error %v, want status %v", resp, err, http.StatusTooManyRequests)
+				}
+			}()
+
+			if tt.wantWait > 0 {
+				clock.BlockUntil(1)
+				clock.Advance(tt.wantWait - 1)
+				if tries != 1 {
+					t.Errorf("got tries %v before wait, want 1", tries)
+				}
+				clock.Advance(1)
+			}
+			<-done
+
+			if tries != tt.wantTries {
+				t.Errorf("got tries %v, want %v", tries, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestRetry_HugeRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		deadline time.Duration
+	}{
+		{name: "must_stop_before_exceeding_max_elapsed", policy: RetryPolicy{MaxAttempts: 3, MaxElapsed: time.Second}},
+		{name: "must_give_up_on_wait_past_deadline", policy: RetryPolicy{MaxAttempts: 3}, deadline: 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Now())
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, clock.Now().Add(tt.deadline))
+				defer cancel()
+			}
+
+			tries := 0
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tries++
+				clock.Advance(time.Millisecond) // the try takes time
+				resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody, Request: r}
+				resp.Header.Set("Retry-After", "99999999999999") // the largest duration
+				return resp, nil
+			})
+
+			// the wait is not capped, so that it overflows if added to
+			retry := Retry(tt.policy, WithRetryClock(clock), WithRetryAfterLimit(0, false))(tripper)
+
+			done := make(chan *http.Response)
+			go func() {
+				resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+				if err != nil {
+					t.Errorf("got error %v, want nil", err)
+				}
+				done <- resp
+			}()
+
+			select {
+			case resp := <-done:
+				if resp != nil && resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusServiceUnavailable)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("got retry waiting, want last response at once")
+			}
+			if tries != 1 {
+				t.Errorf("got tries %v, want 1", tries)
+			}
+		})
+	}
+}
+
+func TestRetry_Deadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []RetryOption
+		wantTries int
+		wantWait  time.Duration
+	}{
+		{name: "must_give_up_on_wait_past_deadline", wantTries: 1},
+		{name: "must_shrink_wait_to_fit_last_try", opts: []RetryOption{WithRetryDeadlineShrink(time.Second)}, wantTries: 2, wantWait: 9 * time.Second},
+		{name: "must_give_up_on_reserve_past_deadline", opts: []RetryOption{WithRetryDeadlineShrink(time.Minute)}, wantTries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Now())
+			ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(10*time.Second))
+			defer cancel()
+
+			tries := 0
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tries++
+				return nil, fmt.Errorf("simulated network error")
+			})
+
+			policy := RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(time.Minute)}
+			retry := Retry(policy, append([]RetryOption{WithRetryClock(clock)}, tt.opts...)...)(tripper)
+
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, err = retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+			}()
+
+			if tt.wantWait > 0 {
+				clock.BlockUntil(1)
+				clock.Advance(tt.wantWait - 1)
+				if tries != 1 {
+					t.Errorf("got tries %v before wait, want 1", tries)
+				}
+				clock.Advance(1)
+			}
+			<-done
+
+			if tries != tt.wantTries {
+				t.Errorf("got tries %v, want %v", tries, tt.wantTries)
+			}
+			if gotDeadline := errors.Is(err, ErrRetryDeadline); gotDeadline != (tt.wantWait == 0) {
+				t.Errorf("got error %v, want deadline error %v", err, tt.wantWait == 0)
+			}
+		})
+	}
+}
+
+// timeoutObserver records the attempts that timed out.
+type timeoutObserver struct {
+	NopRetryObserver
+	timeouts []uint
+	timedOut []bool // by event
+}
+
+func (o *timeoutObserver) OnAttemptTimeout(_ *http.Request, i uint) {
+	o.timeouts = append(o.timeouts, i)
+}
+
+func (o *timeoutObserver) OnRetryEvent(e RetryEvent) {
+	o.timedOut = append(o.timedOut, e.TimedOut)
+}
+
+func TestRetry_AttemptTimeout(t *testing.T) {
+	var ctxs []context.Context
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		ctxs = append(ctxs, r.Context())
+		if len(ctxs) == 1 { // hang until the try times out
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Request: r}, nil
+	})
+
+	observer := &timeoutObserver{}
+	policy := RetryPolicy{
+		MaxAttempts: 2,
+		ShouldRetry: func(*http.Response, error, uint) bool { return false },
+		Backoff:     ConstantBackoff(0),
+	}
+	retry := Retry(policy, WithRetryObserver(observer), WithRetryAttemptTimeout(10*time.Millisecond))(tripper)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got response %v and error %v, want status %v", resp, err, http.StatusOK)
+	}
+	if len(ctxs) != 2 {
+		t.Fatalf("got %v tries, want 2", len(ctxs))
+	}
+	if fmt.Sprint(observer.timeouts) != "[1]" {
+		t.Errorf("got timeouts %v, want [1]", observer.timeouts)
+	}
+	if fmt.Sprint(observer.timedOut) != "[true false]" {
+		t.Errorf("got events timed out %v, want [true false]", observer.timedOut)
+	}
+
+	// the accepted try's context must outlive the round trip until close
+	if err := ctxs[1].Err(); err != nil {
+		t.Errorf("got try context error %v before close, want nil", err)
+	}
+	if data, _ := io.ReadAll(resp.Body); string(data) != "ok" {
+		t.Errorf("got body '%s', want 'ok'", data)
+	}
+	resp.Body.Close()
+	if err := ctxs[1].Err(); err == nil {
+		t.Errorf("got nil try context error after close, want error")
+	}
+}
+
+func TestRetry_AttemptTimeout_Exhausted(t *testing.T) {
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+
+	observer := &timeoutObserver{}
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(0)}
+	retry := Retry(policy, WithRetryObserver(observer), WithRetryAttemptTimeout(time.Millisecond))(tripper)
+
+	_, err := retry.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if !errors.Is(err, ErrAttemptTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want attempt timeout", err)
+	}
+	if fmt.Sprint(observer.timeouts) != "[1 2]" {
+		t.Errorf("got timeouts %v, want [1 2]", observer.timeouts)
+	}
+}
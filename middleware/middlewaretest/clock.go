@@ -0,0 +1,118 @@
+// Package middlewaretest provides utilities for testing code built on package
+// middleware.
+package middlewaretest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// waiter is a pending After channel that fires at deadline.
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// Clock is a fake clock that only moves when advanced. It satisfies
+// middleware.Clock and is safe for concurrent use. The zero value is a clock
+// set to the zero time.
+type Clock struct {
+	now     time.Time
+	waiters []waiter
+	changed chan struct{}
+
+	mutex sync.Mutex
+}
+
+// NewClock returns a new Clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// After returns a channel that receives the clock's time once it has been
+// advanced by at least d. If d <= 0, the channel receives immediately.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), c: ch})
+	c.notify()
+
+	return ch
+}
+
+// Advance moves the clock forward by d and fires every After channel whose
+// deadline has been reached, in deadline order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+
+	var pending []waiter
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+	c.notify()
+}
+
+// Waiters returns the number of After channels that have not fired yet.
+func (c *Clock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n After channels are waiting to fire. It is
+// useful to synchronize a test with code that waits on the clock in another
+// goroutine before calling Advance.
+func (c *Clock) BlockUntil(n int) {
+	for {
+		c.mutex.Lock()
+		if len(c.waiters) >= n {
+			c.mutex.Unlock()
+			return
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.mutex.Unlock()
+
+		<-changed
+	}
+}
+
+// notify wakes any goroutine blocked in BlockUntil. The caller must hold the
+// mutex.
+func (c *Clock) notify() {
+	if c.changed != nil {
+		close(c.changed)
+	}
+	c.changed = make(chan struct{})
+}
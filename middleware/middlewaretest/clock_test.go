@@ -0,0 +1,73 @@
+package middlewaretest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock_Now(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("got %v, want %v", got, start)
+	}
+
+	clock.Advance(time.Minute)
+	if got, want := clock.Now(), start.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestClock_After(t *testing.T) {
+	tests := []struct {
+		name     string
+		after    time.Duration
+		advance  time.Duration
+		wantFire bool
+	}{
+		{name: "must_fire_immediately_on_non_positive", after: 0, wantFire: true},
+		{name: "must_not_fire_before_deadline", after: time.Second, advance: time.Second - 1},
+		{name: "must_fire_on_deadline", after: time.Second, advance: time.Second, wantFire: true},
+		{name: "must_fire_past_deadline", after: time.Second, advance: time.Hour, wantFire: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewClock(time.Time{})
+			c := clock.After(tt.after)
+			clock.Advance(tt.advance)
+
+			select {
+			case <-c:
+				if !tt.wantFire {
+					t.Errorf("got fire, want none")
+				}
+			default:
+				if tt.wantFire {
+					t.Errorf("got no fire, want fire")
+				}
+			}
+		})
+	}
+}
+
+func TestClock_BlockUntil(t *testing.T) {
+	var clock Clock
+
+	done := make(chan time.Time)
+	go func() { done <- <-clock.After(time.Second) }()
+
+	clock.BlockUntil(1)
+	if got := clock.Waiters(); got != 1 {
+		t.Fatalf("got waiters %v, want 1", got)
+	}
+
+	clock.Advance(time.Second)
+	if got := <-done; !got.Equal(time.Time{}.Add(time.Second)) {
+		t.Errorf("got %v, want %v", got, time.Time{}.Add(time.Second))
+	}
+	if got := clock.Waiters(); got != 0 {
+		t.Errorf("got waiters %v, want 0", got)
+	}
+}
@@ -0,0 +1,223 @@
+package middlewaretest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ErrNoRoute is returned by a Transport for a request that matches no route.
+var ErrNoRoute = errors.New("no route matches request")
+
+// Reply is one canned answer of a Route: the error Err if it is set, and
+// otherwise a response with Status, Header and Body. Either is given after
+// Delay, unless the request context is done first.
+type Reply struct {
+	Status int // 200 if 0
+	Header http.Header
+	Body   string
+	Err    error
+	Delay  time.Duration
+}
+
+// Call is a request received by a Transport, with its body read in full.
+type Call struct {
+	Request *http.Request
+	Body    []byte
+}
+
+// Route answers the requests it matches with its replies in sequence; the
+// last reply answers any requests beyond them. A Route without replies
+// answers 200 OK with an empty body. Routes are created with Transport.On and
+// Transport.OnFunc.
+type Route struct {
+	match   func(*http.Request) bool
+	replies []Reply
+	calls   int
+	mutex   sync.Mutex
+}
+
+// Reply appends replies to the route's sequence and returns the route.
+func (route *Route) Reply(replies ...Reply) *Route {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	route.replies = append(route.replies, replies...)
+	return route
+}
+
+// Respond appends a reply with status and body and returns the route.
+func (route *Route) Respond(status int, body string) *Route {
+	return route.Reply(Reply{Status: status, Body: body})
+}
+
+// Fail appends a reply with err and returns the route.
+func (route *Route) Fail(err error) *Route {
+	return route.Reply(Reply{Err: err})
+}
+
+// Calls returns the number of requests the route answered.
+func (route *Route) Calls() int {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	return route.calls
+}
+
+// next returns the reply for the next request.
+func (route *Route) next() Reply {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	route.calls++
+	if len(route.replies) == 0 {
+		return Reply{}
+	}
+	return route.replies[min(route.calls, len(route.replies))-1]
+}
+
+// TransportOption is a function that sets a Transport option.
+type TransportOption func(*Transport)
+
+// WithTransportStrict sets Transport to fail the test on a request that
+// matches no route.
+func WithTransportStrict() TransportOption {
+	return func(tr *Transport) { tr.strict = true }
+}
+
+// WithTransportClock sets Transport to wait out reply delays on clock.
+func WithTransportClock(clock *Clock) TransportOption {
+	return func(tr *Transport) { tr.after = clock.After }
+}
+
+// Transport is a programmable http.RoundTripper for tests. It answers each
+// request with the first route, in order of creation, that matches it, and
+// records every request it receives. A request that matches no route gets
+// ErrNoRoute and, in strict mode, fails the test. It is safe for concurrent
+// use.
+type Transport struct {
+	t      testing.TB
+	strict bool
+	after  func(time.Duration) <-chan time.Time
+
+	routes []*Route
+	calls  []Call
+	mutex  sync.Mutex
+}
+
+// NewTransport returns a Transport without routes that reports to t. By
+// default, it is not strict and waits out delays with time.After.
+func NewTransport(t testing.TB, opts ...TransportOption) *Transport {
+	tr := &Transport{t: t, after: time.After}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	return tr
+}
+
+// On adds a route for requests with method, or any method if method is
+// empty, whose URL path matches pattern as defined by path.Match.
+func (tr *Transport) On(method, pattern string) *Route {
+	tr.t.Helper()
+	if _, err := path.Match(pattern, ""); err != nil {
+		tr.t.Fatalf("invalid route pattern %q: %v", pattern, err)
+	}
+
+	return tr.OnFunc(func(r *http.Request) bool {
+		ok, _ := path.Match(pattern, r.URL.Path)
+		return ok && (method == "" || r.Method == method)
+	})
+}
+
+// OnFunc adds a route for requests for which match returns true.
+func (tr *Transport) OnFunc(match func(*http.Request) bool) *Route {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	route := &Route{match: match}
+	tr.routes = append(tr.routes, route)
+	return route
+}
+
+// Calls returns the requests received so far, in order of arrival.
+func (tr *Transport) Calls() []Call {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return append([]Call(nil), tr.calls...)
+}
+
+// RoundTrip records r and answers it with the next reply of the first route
+// that matches it.
+func (tr *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	call := Call{Request: r.Clone(r.Context()), Body: body}
+	call.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	tr.mutex.Lock()
+	tr.calls = append(tr.calls, call)
+	var route *Route
+	for _, candidate := range tr.routes {
+		if candidate.match(call.Request) {
+			route = candidate
+			break
+		}
+	}
+	tr.mutex.Unlock()
+
+	if route == nil {
+		if tr.strict {
+			tr.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		return nil, fmt.Errorf("%w: %s %s", ErrNoRoute, r.Method, r.URL)
+	}
+
+	reply := route.next()
+	if reply.Delay > 0 {
+		select {
+		case <-tr.after(reply.Delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+
+	status := reply.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := reply.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(reply.Body)),
+		ContentLength: int64(len(reply.Body)),
+		Request:       r,
+	}, nil
+}
@@ -0,0 +1,195 @@
+package middlewaretest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingTB records the failures reported to it instead of failing.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (tb *recordingTB) Helper() {}
+
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func TestTransport_Routes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		wantStatus int
+		wantBody   string
+		wantErr    error
+	}{
+		{name: "must_match_method_and_path", method: http.MethodGet, url: "http://example.com/users/1", wantStatus: http.StatusOK, wantBody: "user"},
+		{name: "must_match_first_route", method: http.MethodGet, url: "http://example.com/users/me", wantStatus: http.StatusOK, wantBody: "user"},
+		{name: "must_match_any_method", method: http.MethodDelete, url: "http://example.com/health", wantStatus: http.StatusNoContent},
+		{name: "must_match_predicate", method: http.MethodPost, url: "http://example.com/x?debug=1", wantStatus: http.StatusTeapot},
+		{name: "must_skip_other_method", method: http.MethodPost, url: "http://example.com/users/1", wantErr: ErrNoRoute},
+		{name: "must_skip_other_path", method: http.MethodGet, url: "http://example.com/users/1/posts", wantErr: ErrNoRoute},
+	}
+
+	transport := NewTransport(t)
+	transport.On(http.MethodGet, "/users/*").Respond(http.StatusOK, "user")
+	transport.On(http.MethodGet, "/users/me").Respond(http.StatusOK, "me")
+	transport.On("", "/health").Respond(http.StatusNoContent, "")
+	transport.OnFunc(func(r *http.Request) bool { return r.URL.Query().Has("debug") }).Respond(http.StatusTeapot, "")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, tt.url, nil)
+			resp, err := transport.RoundTrip(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("got body '%s', want '%v'", body, tt.wantBody)
+			}
+			if resp.Request != r {
+				t.Errorf("got response for another request, want for the request sent")
+			}
+		})
+	}
+}
+
+func TestTransport_Sequence(t *testing.T) {
+	errReset := errors.New("connection reset")
+
+	transport := NewTransport(t)
+	route := transport.On(http.MethodGet, "/").
+		Fail(errReset).
+		Respond(http.StatusServiceUnavailable, "").
+		Reply(Reply{Status: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Body: "done"})
+
+	want := []struct {
+		status int
+		err    error
+	}{
+		{err: errReset},
+		{status: http.StatusServiceUnavailable},
+		{status: http.StatusOK},
+		{status: http.StatusOK}, // the last reply repeats
+	}
+	for i, w := range want {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp, err := transport.RoundTrip(r)
+		if !errors.Is(err, w.err) {
+			t.Errorf("call %d: got error %v, want %v", i+1, err, w.err)
+			continue
+		}
+		if err == nil && resp.StatusCode != w.status {
+			t.Errorf("call %d: got status %v, want %v", i+1, resp.StatusCode, w.status)
+		}
+	}
+
+	if got := route.Calls(); got != len(want) {
+		t.Errorf("got %v route calls, want %v", got, len(want))
+	}
+}
+
+func TestTransport_Calls(t *testing.T) {
+	transport := NewTransport(t)
+	transport.On(http.MethodPost, "/orders")
+
+	r, _ := http.NewRequest(http.MethodPost, "http://example.com/orders", strings.NewReader(`{"id":1}`))
+	r.Header.Set("X-Tenant", "acme")
+	transport.RoundTrip(r)
+	r, _ = http.NewRequest(http.MethodGet, "http://example.com/unknown", nil)
+	transport.RoundTrip(r)
+
+	calls := transport.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %v calls, want 2", len(calls))
+	}
+	if got := string(calls[0].Body); got != `{"id":1}` {
+		t.Errorf("got body '%v', want '%v'", got, `{"id":1}`)
+	}
+	if got, _ := io.ReadAll(calls[0].Request.Body); string(got) != `{"id":1}` {
+		t.Errorf("got recorded request body '%s', want '%v'", got, `{"id":1}`)
+	}
+	if got := calls[0].Request.Header.Get("X-Tenant"); got != "acme" {
+		t.Errorf("got X-Tenant '%v', want 'acme'", got)
+	}
+	if got := calls[1].Request.URL.Path; got != "/unknown" {
+		t.Errorf("got path '%v', want '/unknown'", got)
+	}
+}
+
+func TestTransport_Strict(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []TransportOption
+		wantErrors int
+	}{
+		{name: "must_fail_test_on_unexpected_request", opts: []TransportOption{WithTransportStrict()}, wantErrors: 1},
+		{name: "must_not_fail_test_if_not_strict", wantErrors: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &recordingTB{TB: t}
+			transport := NewTransport(tb, tt.opts...)
+			transport.On(http.MethodGet, "/")
+
+			for _, path := range []string{"/", "/unexpected"} {
+				r, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+				transport.RoundTrip(r)
+			}
+
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v test failures %v, want %v", got, tb.errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestTransport_Delay(t *testing.T) {
+	clock := NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	transport := NewTransport(t, WithTransportClock(clock))
+	transport.On("", "/").Reply(Reply{Delay: time.Second})
+
+	done := make(chan error)
+	go func() {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		_, err := transport.RoundTrip(r)
+		done <- err
+	}()
+
+	clock.BlockUntil(1)
+	select {
+	case <-done:
+		t.Fatalf("got reply before delay, want after")
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+
+	// a canceled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	if _, err := transport.RoundTrip(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
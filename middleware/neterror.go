@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass describes the cause of a round trip error.
+type ErrorClass string
+
+const (
+	ErrorClassNone         ErrorClass = ""
+	ErrorClassCanceled     ErrorClass = "canceled"
+	ErrorClassInvalid      ErrorClass = "invalid"
+	ErrorClassTLS          ErrorClass = "tls"
+	ErrorClassDNSPermanent ErrorClass = "dns_permanent"
+	ErrorClassDNSTemporary ErrorClass = "dns_temporary"
+	ErrorClassRefused      ErrorClass = "refused"
+	ErrorClassReset        ErrorClass = "reset"
+	ErrorClassTimeout      ErrorClass = "timeout"
+	ErrorClassUnknown      ErrorClass = "unknown"
+)
+
+// Retryable reports whether an error of class c may succeed if tried again.
+// Canceled requests, invalid requests, TLS failures and permanent DNS
+// failures are not retryable; any other error is.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassNone, ErrorClassCanceled, ErrorClassInvalid, ErrorClassTLS, ErrorClassDNSPermanent:
+		return false
+	}
+	return true
+}
+
+// Failure reports whether an error of class c is caused by the upstream or
+// the network rather than by the caller. Canceled and invalid requests are
+// not failures; any other error is.
+func (c ErrorClass) Failure() bool {
+	switch c {
+	case ErrorClassNone, ErrorClassCanceled, ErrorClassInvalid:
+		return false
+	}
+	return true
+}
+
+// ClassifyError returns the class of err, or ErrorClassNone if err is nil.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	}
+
+	if isTLSError(err) {
+		return ErrorClassTLS
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound && !dnsErr.IsTemporary {
+			return ErrorClassDNSPermanent
+		}
+		return ErrorClassDNSTemporary
+	}
+
+	if isInvalidRequestError(err) {
+		return ErrorClassInvalid
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassRefused
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassReset
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+
+	return ErrorClassUnknown
+}
+
+// isTLSError returns true if err reports a failed TLS handshake or an invalid
+// certificate.
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// isInvalidRequestError returns true if err reports a request that could
+// never be sent, such as one with a malformed URL.
+func isInvalidRequestError(err error) bool {
+	var escapeErr url.EscapeError
+	var hostErr url.InvalidHostError
+	if errors.As(err, &escapeErr) || errors.As(err, &hostErr) {
+		return true
+	}
+
+	// net/http reports these without a distinct type
+	msg := err.Error()
+	return strings.Contains(msg, "unsupported protocol scheme") ||
+		strings.Contains(msg, "no Host in request URL") ||
+		strings.Contains(msg, "nil Request.URL")
+}
+
+// ErrNotSent matches, with errors.Is, the error of a Retry attempt that failed
+// before any of the request was written, such as on a refused connection. A
+// request that was not sent may be retried even if it is not idempotent.
+var ErrNotSent = errors.New("request not sent")
+
+// notSentError wraps an error so that it matches ErrNotSent without changing
+// its message.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string        { return e.err.Error() }
+func (e *notSentError) Unwrap() error        { return e.err }
+func (e *notSentError) Is(target error) bool { return target == ErrNotSent }
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "must_be_none_on_nil", err: nil, want: ErrorClassNone},
+		{name: "must_be_canceled_on_context_canceled", err: fmt.Errorf("get: %w", context.Canceled), want: ErrorClassCanceled},
+		{name: "must_be_timeout_on_context_deadline", err: context.DeadlineExceeded, want: ErrorClassTimeout},
+		{name: "must_be_timeout_on_io_deadline", err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, want: ErrorClassTimeout},
+		{name: "must_be_refused_on_econnrefused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: ErrorClassRefused},
+		{name: "must_be_reset_on_econnreset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: ErrorClassReset},
+		{name: "must_be_reset_on_unexpected_eof", err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), want: ErrorClassReset},
+		{name: "must_be_dns_permanent_on_not_found", err: &net.DNSError{Err: "no such host", IsNotFound: true}, want: ErrorClassDNSPermanent},
+		{name: "must_be_dns_temporary_on_temporary", err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, want: ErrorClassDNSTemporary},
+		{name: "must_be_dns_temporary_on_timeout", err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}, want: ErrorClassDNSTemporary},
+		{name: "must_be_tls_on_unknown_authority", err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, want: ErrorClassTLS},
+		{name: "must_be_tls_on_hostname_mismatch", err: fmt.Errorf("tls: %w", x509.HostnameError{Host: "example.com"}), want: ErrorClassTLS},
+		{name: "must_be_tls_on_alert", err: tls.AlertError(42), want: ErrorClassTLS},
+		{name: "must_be_invalid_on_unsupported_scheme", err: errors.New(`unsupported protocol scheme "ftp"`), want: ErrorClassInvalid},
+		{name: "must_be_invalid_on_bad_host", err: &url.Error{Op: "parse", Err: url.InvalidHostError("%")}, want: ErrorClassInvalid},
+		{name: "must_be_unknown_on_other", err: errors.New("simulated network error"), want: ErrorClassUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("got class %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		class         ErrorClass
+		wantRetryable bool
+		wantFailure   bool
+	}{
+		{class: ErrorClassNone},
+		{class: ErrorClassCanceled},
+		{class: ErrorClassInvalid},
+		{class: ErrorClassTLS, wantFailure: true},
+		{class: ErrorClassDNSPermanent, wantFailure: true},
+		{class: ErrorClassDNSTemporary, wantRetryable: true, wantFailure: true},
+		{class: ErrorClassRefused, wantRetryable: true, wantFailure: true},
+		{class: ErrorClassReset, wantRetryable: true, wantFailure: true},
+		{class: ErrorClassTimeout, wantRetryable: true, wantFailure: true},
+		{class: ErrorClassUnknown, wantRetryable: true, wantFailure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run("must_classify_"+string(tt.class), func(t *testing.T) {
+			if got := tt.class.Retryable(); got != tt.wantRetryable {
+				t.Errorf("got retryable %v, want %v", got, tt.wantRetryable)
+			}
+			if got := tt.class.Failure(); got != tt.wantFailure {
+				t.Errorf("got failure %v, want %v", got, tt.wantFailure)
+			}
+		})
+	}
+}
+
+func TestRetry_NotSent(t *testing.T) {
+	// a closed listener leaves an address that refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	refused := "http://" + ln.Addr().String()
+	ln.Close()
+
+	// a server that hangs up after reading the request
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer reset.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		wantTries uint
+		wantSent  bool
+	}{
+		{name: "must_retry_post_on_refused_connection", url: refused, wantTries: 3},
+		{name: "must_not_retry_post_on_reset_after_write", url: reset.URL, wantTries: 1, wantSent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observer := &recordingObserver{}
+			transport := &http.Transport{DisableKeepAlives: true}
+			defer transport.CloseIdleConnections()
+
+			policy := RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(time.Millisecond)}
+			retry := Retry(policy, WithRetryObserver(observer))(transport)
+
+			r, err := http.NewRequest(http.MethodPost, tt.url, strings.NewReader("data"))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err.Error())
+			}
+			_, err = retry.RoundTrip(r)
+			if err == nil {
+				t.Fatalf("got nil error, want error")
+			}
+
+			if got := uint(len(observer.tries)); got != tt.wantTries {
+				t.Errorf("got tries %v, want %v", got, tt.wantTries)
+			}
+			if gotSent := !errors.Is(err, ErrNotSent); gotSent != tt.wantSent {
+				t.Errorf("got error %v, want sent %v", err, tt.wantSent)
+			}
+		})
+	}
+}
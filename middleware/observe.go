@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryDecision describes what a Retry RoundTripper did after an attempt.
+type RetryDecision string
+
+const (
+	RetryDecisionAccept             RetryDecision = "accept"
+	RetryDecisionRetry              RetryDecision = "retry"
+	RetryDecisionNotRetryable       RetryDecision = "not_retryable"
+	RetryDecisionNotIdempotent      RetryDecision = "not_idempotent"
+	RetryDecisionExhausted          RetryDecision = "exhausted"
+	RetryDecisionRetryAfterExceeded RetryDecision = "retry_after_exceeded"
+	RetryDecisionMaxElapsed         RetryDecision = "max_elapsed"
+	RetryDecisionDeadline           RetryDecision = "deadline"
+	RetryDecisionBodyNotReplayable  RetryDecision = "body_not_replayable"
+	RetryDecisionBudgetDenied       RetryDecision = "budget_denied"
+	RetryDecisionCanceled           RetryDecision = "canceled"
+)
+
+// RetryEvent describes the outcome of a single attempt of a Retry
+// RoundTripper. Status is 0 if the attempt returned no response. TimedOut is
+// true if the attempt ran out of the time set with WithRetryAttemptTimeout.
+// Delay is the wait before the next attempt and is only set if Decision is
+// RetryDecisionRetry. Elapsed is measured from the start of the first attempt.
+type RetryEvent struct {
+	Request  *http.Request
+	Attempt  uint
+	Status   int
+	Err      error
+	TimedOut bool
+	Delay    time.Duration
+	Elapsed  time.Duration
+	Decision RetryDecision
+}
+
+// RetryEventObserver is the interface implemented by a RetryObserver that
+// wants a RetryEvent for every attempt. It is detected with a type
+// assertion, so existing observers need not implement it.
+type RetryEventObserver interface {
+	OnRetryEvent(RetryEvent)
+}
+
+// SlogRetryObserver is a RetryObserver that logs every RetryEvent. Retries
+// are logged at Warn level, accepted responses at Debug level, and any other
+// decision, which ends the round trip without success, at Error level.
+type SlogRetryObserver struct {
+	NopRetryObserver
+
+	logger *slog.Logger
+	prefix string
+}
+
+// NewSlogRetryObserver returns a new SlogRetryObserver that logs with prefix
+// as the message.
+//
+// If logger is nil, slog.Default() is used.
+func NewSlogRetryObserver(logger *slog.Logger, prefix string) *SlogRetryObserver {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &SlogRetryObserver{logger: logger, prefix: prefix}
+}
+
+func (o *SlogRetryObserver) OnRetryEvent(e RetryEvent) {
+	level := slog.LevelError
+	switch e.Decision {
+	case RetryDecisionAccept:
+		level = slog.LevelDebug
+	case RetryDecisionRetry:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", e.Request.Method),
+		slog.String("dest", e.Request.URL.String()),
+		slog.Uint64("attempt", uint64(e.Attempt)),
+		slog.Int("status", e.Status),
+		slog.String("decision", string(e.Decision)),
+		slog.Duration("delay", e.Delay),
+		slog.Duration("elapsed", e.Elapsed),
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	}
+	if e.TimedOut {
+		attrs = append(attrs, slog.Bool("timed-out", true))
+	}
+
+	o.logger.LogAttrs(e.Request.Context(), level, o.prefix, attrs...)
+}
+
+// RetryStats is a point-in-time copy of the counters of a RetryMetrics.
+type RetryStats struct {
+	Attempts  uint64                   `json:"attempts"`
+	Timeouts  uint64                   `json:"timeouts"`
+	Delay     time.Duration            `json:"delay"`
+	Decisions map[RetryDecision]uint64 `json:"decisions"`
+}
+
+// RetryMetrics is a RetryObserver that counts attempts, attempts that timed
+// out, the total delay spent between attempts, and decisions. It is safe for
+// concurrent use and its zero value is ready to use. It implements
+// expvar.Var, so it may be published with expvar.Publish.
+type RetryMetrics struct {
+	stats RetryStats
+	mutex sync.Mutex
+}
+
+func (m *RetryMetrics) OnTry(*http.Request, uint) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stats.Attempts++
+}
+
+func (m *RetryMetrics) OnAttemptTimeout(*http.Request, uint) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stats.Timeouts++
+}
+
+func (m *RetryMetrics) OnSuccess(*http.Request, uint)        {}
+func (m *RetryMetrics) OnFailure(*http.Request, uint, error) {}
+
+func (m *RetryMetrics) OnRetryEvent(e RetryEvent) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stats.Decisions == nil {
+		m.stats.Decisions = map[RetryDecision]uint64{}
+	}
+	m.stats.Decisions[e.Decision]++
+	m.stats.Delay += e.Delay
+}
+
+// Stats returns a copy of the current counters.
+func (m *RetryMetrics) Stats() RetryStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := m.stats
+	stats.Decisions = make(map[RetryDecision]uint64, len(m.stats.Decisions))
+	for k, v := range m.stats.Decisions {
+		stats.Decisions[k] = v
+	}
+
+	return stats
+}
+
+// String returns the current counters as JSON.
+func (m *RetryMetrics) String() string {
+	data, err := json.Marshal(m.Stats())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
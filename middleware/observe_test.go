@@ -0,0 +1,242 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+// eventObserver records every RetryEvent.
+type eventObserver struct {
+	NopRetryObserver
+	events []RetryEvent
+}
+
+func (o *eventObserver) OnRetryEvent(e RetryEvent) { o.events = append(o.events, e) }
+
+func TestRetry_Events(t *testing.T) {
+	const failed = 0 // status for a simulated network error
+
+	tests := []struct {
+		name          string
+		method        string
+		policy        RetryPolicy
+		statuses      []int
+		wantDecisions []RetryDecision
+	}{
+		{
+			name:          "must_emit_retry_and_accept",
+			method:        http.MethodGet,
+			policy:        RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(time.Second)},
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusOK},
+			wantDecisions: []RetryDecision{RetryDecisionRetry, RetryDecisionAccept},
+		},
+		{
+			name:          "must_emit_exhausted",
+			method:        http.MethodGet,
+			policy:        RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(time.Second)},
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantDecisions: []RetryDecision{RetryDecisionRetry, RetryDecisionExhausted},
+		},
+		{
+			name:          "must_emit_not_idempotent",
+			method:        http.MethodPost,
+			policy:        RetryPolicy{MaxAttempts: 2},
+			statuses:      []int{http.StatusServiceUnavailable},
+			wantDecisions: []RetryDecision{RetryDecisionNotIdempotent},
+		},
+		{
+			name:   "must_emit_not_retryable",
+			method: http.MethodGet,
+			policy: RetryPolicy{
+				MaxAttempts: 2,
+				ShouldRetry: func(*http.Response, error, uint) bool { return false },
+			},
+			statuses:      []int{failed},
+			wantDecisions: []RetryDecision{RetryDecisionNotRetryable},
+		},
+		{
+			name:          "must_emit_max_elapsed",
+			method:        http.MethodGet,
+			policy:        RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(time.Minute), MaxElapsed: time.Second},
+			statuses:      []int{http.StatusServiceUnavailable},
+			wantDecisions: []RetryDecision{RetryDecisionMaxElapsed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			tries := 0
+			tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				status := tt.statuses[tries]
+				tries++
+				if status == failed {
+					return nil, fmt.Errorf("simulated network error")
+				}
+				return &http.Response{StatusCode: status, Body: http.NoBody, Request: r}, nil
+			})
+
+			observer := &eventObserver{}
+			retry := Retry(tt.policy, WithRetryObserver(observer), WithRetryClock(clock))(tripper)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				retry.RoundTrip(httptest.NewRequest(tt.method, "/", nil))
+			}()
+
+			for waiting := true; waiting; {
+				select {
+				case <-done:
+					waiting = false
+				case <-time.After(time.Millisecond):
+					clock.Advance(time.Second)
+				}
+			}
+
+			var got []RetryDecision
+			for _, e := range observer.events {
+				got = append(got, e.Decision)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantDecisions) {
+				t.Errorf("got decisions %v, want %v", got, tt.wantDecisions)
+			}
+
+			for i, e := range observer.events {
+				if e.Attempt != uint(i+1) {
+					t.Errorf("event %d: got attempt %v, want %v", i, e.Attempt, i+1)
+				}
+				if want := tt.statuses[i]; e.Status != want {
+					t.Errorf("event %d: got status %v, want %v", i, e.Status, want)
+				}
+				if e.Decision == RetryDecisionRetry && e.Delay != time.Second {
+					t.Errorf("event %d: got delay %v, want %v", i, e.Delay, time.Second)
+				}
+				if e.Decision != RetryDecisionRetry && e.Delay != 0 {
+					t.Errorf("event %d: got delay %v, want 0", i, e.Delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetry_Events_GetBodyError(t *testing.T) {
+	tripper := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+	})
+
+	observer := &eventObserver{}
+	retry := Retry(RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(0)}, WithRetryObserver(observer))(tripper)
+
+	r, _ := http.NewRequest(http.MethodPut, "http://example.com/", strings.NewReader("payload"))
+	r.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("simulated replay error") }
+	_, err := retry.RoundTrip(r)
+
+	if !errors.Is(err, ErrBodyNotReplayable) {
+		t.Errorf("got error %v, want %v", err, ErrBodyNotReplayable)
+	}
+	if len(observer.events) != 1 || observer.events[0].Decision != RetryDecisionBodyNotReplayable {
+		t.Errorf("got events %v, want a single %v", observer.events, RetryDecisionBodyNotReplayable)
+	}
+}
+
+func TestSlogRetryObserver(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	tests := []struct {
+		name  string
+		event RetryEvent
+		want  []string
+	}{
+		{
+			name:  "must_log_accept_at_debug",
+			event: RetryEvent{Attempt: 1, Status: http.StatusOK, Decision: RetryDecisionAccept},
+			want:  []string{"level=DEBUG", "msg=retry", "attempt=1", "status=200", "decision=accept"},
+		},
+		{
+			name:  "must_log_retry_at_warn",
+			event: RetryEvent{Attempt: 1, Status: http.StatusServiceUnavailable, Delay: time.Second, Decision: RetryDecisionRetry},
+			want:  []string{"level=WARN", "status=503", "decision=retry", "delay=1s"},
+		},
+		{
+			name:  "must_log_give_up_at_error_with_error",
+			event: RetryEvent{Attempt: 3, Err: fmt.Errorf("simulated network error"), Decision: RetryDecisionExhausted},
+			want:  []string{"level=ERROR", "decision=exhausted", `error="simulated network error"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer buf.Reset()
+
+			tt.event.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			NewSlogRetryObserver(logger, "retry").OnRetryEvent(tt.event)
+
+			got := buf.String()
+			for _, sub := range tt.want {
+				if !strings.Contains(got, sub) {
+					t.Errorf("'%s' does not contain '%s'", got, sub)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSlogRetryObserver(t *testing.T) {
+	if got := NewSlogRetryObserver(nil, "").logger; got != slog.Default() {
+		t.Errorf("got logger %v, want slog.Default()", got)
+	}
+}
+
+func TestRetryMetrics(t *testing.T) {
+	var metrics RetryMetrics
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	metrics.OnTry(r, 1)
+	metrics.OnAttemptTimeout(r, 1)
+	metrics.OnRetryEvent(RetryEvent{Request: r, Attempt: 1, Delay: time.Second, Decision: RetryDecisionRetry})
+	metrics.OnTry(r, 2)
+	metrics.OnRetryEvent(RetryEvent{Request: r, Attempt: 2, Decision: RetryDecisionAccept})
+	metrics.OnSuccess(r, 2)
+
+	stats := metrics.Stats()
+	if stats.Attempts != 2 {
+		t.Errorf("got attempts %v, want 2", stats.Attempts)
+	}
+	if stats.Timeouts != 1 {
+		t.Errorf("got timeouts %v, want 1", stats.Timeouts)
+	}
+	if stats.Delay != time.Second {
+		t.Errorf("got delay %v, want %v", stats.Delay, time.Second)
+	}
+	if stats.Decisions[RetryDecisionRetry] != 1 || stats.Decisions[RetryDecisionAccept] != 1 {
+		t.Errorf("got decisions %v, want one retry and one accept", stats.Decisions)
+	}
+
+	// stats must be a copy
+	stats.Decisions[RetryDecisionRetry] = 100
+	if got := metrics.Stats().Decisions[RetryDecisionRetry]; got != 1 {
+		t.Errorf("got retry decisions %v after modifying copy, want 1", got)
+	}
+
+	var decoded RetryStats
+	if err := json.Unmarshal([]byte(metrics.String()), &decoded); err != nil {
+		t.Fatalf("failed to unmarshal String: %s", err.Error())
+	}
+	if decoded.Attempts != 2 {
+		t.Errorf("got decoded attempts %v, want 2", decoded.Attempts)
+	}
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// String returns "closed" or "open".
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerStateClosed:
+		return "closed"
+	case BreakerStateOpen:
+		return "open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s BreakerState) MarshalText() ([]byte, error) {
+	switch s {
+	case BreakerStateClosed, BreakerStateOpen:
+		return []byte(s.String()), nil
+	}
+	return nil, fmt.Errorf("invalid breaker state %d", int(s))
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *BreakerState) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "closed":
+		*s = BreakerStateClosed
+	case "open":
+		*s = BreakerStateOpen
+	default:
+		return fmt.Errorf("invalid breaker state %q", text)
+	}
+	return nil
+}
+
+// breakerSnapshot is the persisted form of a CircuitBreaker.
+type breakerSnapshot struct {
+	State    BreakerState `json:"state"`
+	Showtime time.Time    `json:"showtime"`
+	Failures uint         `json:"failures"`
+}
+
+// snapshot returns the breaker's current state.
+func (breaker *CircuitBreaker) snapshot() breakerSnapshot {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return breakerSnapshot{State: breaker.state, Showtime: breaker.showtime, Failures: breaker.failures}
+}
+
+// restore sets the breaker's state from snap.
+func (breaker *CircuitBreaker) restore(snap breakerSnapshot) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.state = snap.State
+	breaker.showtime = snap.Showtime.UTC()
+	breaker.failures = snap.Failures
+}
+
+// BreakerRegistry holds named CircuitBreakers sharing one configuration, e.g.
+// one per upstream host. Its state can be exported to and imported from JSON
+// so that open breakers survive a restart.
+type BreakerRegistry struct {
+	threshold uint
+	cooldown  time.Duration
+	opts      []BreakerOption
+	clock     Clock
+
+	breakers map[string]*CircuitBreaker
+	mutex    sync.Mutex
+}
+
+// NewBreakerRegistry returns a new, empty BreakerRegistry. Its breakers are
+// created on demand with NewCircuitBreaker(threshold, cooldown, opts...).
+func NewBreakerRegistry(threshold uint, cooldown time.Duration, opts ...BreakerOption) *BreakerRegistry {
+	return &BreakerRegistry{
+		threshold: threshold,
+		cooldown:  cooldown,
+		opts:      opts,
+		clock:     newBreakerOptions(opts).clock,
+		breakers:  map[string]*CircuitBreaker{},
+	}
+}
+
+// Breaker returns the breaker registered under name, creating it if needed.
+func (reg *BreakerRegistry) Breaker(name string) *CircuitBreaker {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	breaker, ok := reg.breakers[name]
+	if !ok {
+		breaker = NewCircuitBreaker(reg.threshold, reg.cooldown, reg.opts...)
+		reg.breakers[name] = breaker
+	}
+
+	return breaker
+}
+
+// MarshalJSON implements json.Marshaler. It encodes every breaker's state,
+// showtime and failure count by name.
+func (reg *BreakerRegistry) MarshalJSON() ([]byte, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	snaps := make(map[string]breakerSnapshot, len(reg.breakers))
+	for name, breaker := range reg.breakers {
+		snaps[name] = breaker.snapshot()
+	}
+
+	return json.Marshal(snaps)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It restores the breakers encoded
+// in data, creating them if needed. Open entries whose showtime has passed are
+// discarded, since the breaker would have flipped closed anyway.
+func (reg *BreakerRegistry) UnmarshalJSON(data []byte) error {
+	var snaps map[string]breakerSnapshot
+	if err := json.Unmarshal(data, &snaps); err != nil {
+		return err
+	}
+
+	now := reg.clock.Now().UTC()
+	for name, snap := range snaps {
+		if snap.State == BreakerStateOpen && !now.Before(snap.Showtime) {
+			continue
+		}
+		reg.Breaker(name).restore(snap)
+	}
+
+	return nil
+}
+
+// SaveFile writes the registry's JSON state to path. The file is replaced
+// atomically, so readers never observe a partial write.
+func (reg *BreakerRegistry) SaveFile(path string) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// to path, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile restores the registry's state from the JSON file at path. A
+// missing file is not an error.
+func (reg *BreakerRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is supplied by the application
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, reg)
+}
+
+// Snapshot saves the registry's state to path every interval until ctx is
+// done, then saves it a final time and returns the error of that save. A
+// failed periodic save is reported to onError, if it is not nil, and made
+// again after the next interval. Snapshot returns an error at once if
+// interval is not positive.
+func (reg *BreakerRegistry) Snapshot(ctx context.Context, path string, interval time.Duration, onError func(error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid snapshot interval: %v is not positive", interval)
+	}
+
+	for {
+		select {
+		case <-reg.clock.After(interval):
+			if err := reg.SaveFile(path); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return reg.SaveFile(path)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+func TestBreakerState_Text(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   BreakerState
+		text    string
+		wantErr bool
+	}{
+		{name: "must_pass_on_closed", state: BreakerStateClosed, text: "closed"},
+		{name: "must_pass_on_open", state: BreakerStateOpen, text: "open"},
+		{name: "must_error_on_unknown", state: BreakerState(7), text: "half-open", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.state.MarshalText()
+			if gotErr := (err != nil); gotErr != tt.wantErr {
+				t.Errorf("got marshal error %v, want %v", gotErr, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.text {
+				t.Errorf("got text '%v', want '%v'", string(got), tt.text)
+			}
+
+			var state BreakerState
+			err = state.UnmarshalText([]byte(tt.text))
+			if gotErr := (err != nil); gotErr != tt.wantErr {
+				t.Errorf("got unmarshal error %v, want %v", gotErr, tt.wantErr)
+			}
+			if err == nil && state != tt.state {
+				t.Errorf("got state %v, want %v", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestBreakerRegistry_Breaker(t *testing.T) {
+	reg := NewBreakerRegistry(3, time.Minute)
+
+	a := reg.Breaker("a")
+	if a != reg.Breaker("a") {
+		t.Errorf("got new breaker for existing name, want same breaker")
+	}
+	if a == reg.Breaker("b") {
+		t.Errorf("got same breaker for different names, want distinct breakers")
+	}
+	if a.threshold != 3 || a.cooldown != time.Minute {
+		t.Errorf("got threshold %v and cooldown %v, want 3 and %v", a.threshold, a.cooldown, time.Minute)
+	}
+}
+
+func TestBreakerRegistry_JSON(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reg := NewBreakerRegistry(1, time.Minute, WithBreakerClock(middlewaretest.NewClock(start)))
+	reg.Breaker("closed").OnFailure()
+	reg.Breaker("open").OnFailure()
+	reg.Breaker("open").OnFailure()
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err.Error())
+	}
+
+	tests := []struct {
+		name         string
+		restoreAt    time.Time
+		breaker      string
+		wantState    BreakerState
+		wantShowtime time.Time
+		wantFailures uint
+	}{
+		{
+			name:         "must_restore_closed_failures",
+			restoreAt:    start.Add(30 * time.Second),
+			breaker:      "closed",
+			wantState:    BreakerStateClosed,
+			wantShowtime: start,
+			wantFailures: 1,
+		},
+		{
+			name:         "must_restore_open_before_showtime",
+			restoreAt:    start.Add(30 * time.Second),
+			breaker:      "open",
+			wantState:    BreakerStateOpen,
+			wantShowtime: start.Add(time.Minute),
+		},
+		{
+			name:         "must_discard_open_past_showtime",
+			restoreAt:    start.Add(90 * time.Second),
+			breaker:      "open",
+			wantState:    BreakerStateClosed,
+			wantShowtime: start.Add(90 * time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := NewBreakerRegistry(1, time.Minute, WithBreakerClock(middlewaretest.NewClock(tt.restoreAt)))
+			if err := json.Unmarshal(data, restored); err != nil {
+				t.Fatalf("failed to unmarshal: %s", err.Error())
+			}
+
+			snap := restored.Breaker(tt.breaker).snapshot()
+			if snap.State != tt.wantState {
+				t.Errorf("got state %v, want %v", snap.State, tt.wantState)
+			}
+			if !snap.Showtime.Equal(tt.wantShowtime) {
+				t.Errorf("got showtime %v, want %v", snap.Showtime, tt.wantShowtime)
+			}
+			if snap.Failures != tt.wantFailures {
+				t.Errorf("got failures %v, want %v", snap.Failures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestBreakerRegistry_UnmarshalJSON_Error(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "must_error_on_invalid_json", data: "{"},
+		{name: "must_error_on_invalid_state", data: `{"a":{"state":"half-open"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := json.Unmarshal([]byte(tt.data), NewBreakerRegistry(1, time.Minute)); err == nil {
+				t.Errorf("got nil error, want error")
+			}
+		})
+	}
+}
+
+func TestBreakerRegistry_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakers.json")
+
+	reg := NewBreakerRegistry(0, time.Hour)
+	if err := reg.LoadFile(path); err != nil {
+		t.Fatalf("got error %v on missing file, want nil", err)
+	}
+
+	reg.Breaker("a").OnFailure()
+	if err := reg.SaveFile(path); err != nil {
+		t.Fatalf("failed to save: %s", err.Error())
+	}
+
+	restored := NewBreakerRegistry(0, time.Hour)
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("failed to load: %s", err.Error())
+	}
+	if restored.Breaker("a").OK() {
+		t.Errorf("got breaker closed, want open")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+	if err := restored.LoadFile(path); err == nil {
+		t.Errorf("got nil error on invalid file, want error")
+	}
+}
+
+func TestBreakerRegistry_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakers.json")
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	reg := NewBreakerRegistry(0, time.Hour, WithBreakerClock(clock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- reg.Snapshot(ctx, path, time.Minute, nil) }()
+
+	// the first save happens after an interval
+	clock.BlockUntil(1)
+	reg.Breaker("a").OnFailure()
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+
+	restored := NewBreakerRegistry(0, time.Hour, WithBreakerClock(clock))
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("failed to load: %s", err.Error())
+	}
+	if restored.Breaker("a").OK() {
+		t.Errorf("got breaker closed, want open")
+	}
+
+	// the last save happens when ctx is done
+	reg.Breaker("b").OnFailure()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("failed to load: %s", err.Error())
+	}
+	if restored.Breaker("b").OK() {
+		t.Errorf("got breaker closed, want open")
+	}
+}
+
+func TestBreakerRegistry_Snapshot_Errors(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	path := filepath.Join(dir, "breakers.json")
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	reg := NewBreakerRegistry(0, time.Hour, WithBreakerClock(clock))
+
+	if err := reg.Snapshot(context.Background(), path, 0, nil); err == nil {
+		t.Errorf("got nil error on zero interval, want error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	done := make(chan error)
+	go func() { done <- reg.Snapshot(ctx, path, time.Minute, func(err error) { errs <- err }) }()
+
+	// a failed save is reported, and snapshotting goes on
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	if err := <-errs; err == nil {
+		t.Errorf("got nil error on missing directory, want error")
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("failed to create directory: %s", err.Error())
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("got error %v after the next interval, want saved file", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+}
@@ -0,0 +1,424 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SigningKeys is the interface implemented by an object that looks up HMAC
+// keys by key ID. Rotating keys is a matter of adding the new key under a new
+// ID, signing with it, and removing the old key once no request signed with
+// it can still be accepted. SigningKey must be safe for concurrent use.
+type SigningKeys interface {
+	SigningKey(keyID string) ([]byte, error)
+}
+
+// StaticSigningKeys implements SigningKeys with a fixed map from key ID to
+// key.
+type StaticSigningKeys map[string][]byte
+
+func (keys StaticSigningKeys) SigningKey(keyID string) ([]byte, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSigningKey, keyID)
+	}
+	return key, nil
+}
+
+// ErrUnknownSigningKey is returned by a SigningKeys for an unknown key ID.
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+const (
+	// signatureLabel labels the one signature Sign adds.
+	signatureLabel = "sig1"
+	// signatureAlg is the RFC 9421 name of HMAC-SHA256.
+	signatureAlg = "hmac-sha256"
+)
+
+// signatureComponents are the derived components covered by every signature,
+// followed by the Content-Digest header field.
+var signatureComponents = []string{"@method", "@path", "@query", "content-digest"}
+
+// signOptions holds the optional configuration of a Sign RoundTripper.
+type signOptions struct {
+	headers []string
+	clock   Clock
+}
+
+// SignOption is a function that sets a Sign option.
+type SignOption func(*signOptions)
+
+// WithSignHeaders sets Sign to also cover the header fields named in headers.
+// A request lacking one of them fails without being sent.
+func WithSignHeaders(headers ...string) SignOption {
+	return func(o *signOptions) { o.headers = headers }
+}
+
+// WithSignClock sets Sign to tell time using clock.
+func WithSignClock(clock Clock) SignOption {
+	return func(o *signOptions) { o.clock = clock }
+}
+
+// Sign returns middleware that signs every request with HMAC-SHA256 in the
+// style of RFC 9421 HTTP Message Signatures, using the key keys returns for
+// keyID. The signature covers the method, path, query, any header fields
+// set with WithSignHeaders, and the Content-Digest header field of RFC 9530,
+// which Sign sets to the SHA-256 digest of the body. Its parameters carry
+// the creation time, a random nonce, the key ID and the algorithm. Requests
+// signed by Sign are verified by VerifySignature.
+//
+// Sign reads the whole body into memory. Place it inside Retry, so that each
+// attempt gets a fresh timestamp and nonce. By default, Sign uses
+// SystemClock.
+func Sign(keyID string, keys SigningKeys, opts ...SignOption) func(http.RoundTripper) http.RoundTripper {
+	o := signOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	components := append(append([]string(nil), signatureComponents...), lowerAll(o.headers)...)
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			key, err := keys.SigningKey(keyID)
+			if err != nil {
+				return nil, err
+			}
+			nonce, err := newNonce()
+			if err != nil {
+				return nil, err
+			}
+
+			var body []byte
+			if r.Body != nil && r.Body != http.NoBody {
+				body, err = io.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// RoundTrippers must not modify the request
+			req := r.Clone(r.Context())
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				req.Body = io.NopCloser(bytes.NewReader(body))
+				req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+			}
+			req.Header.Set("Content-Digest", contentDigest(body))
+
+			params := fmt.Sprintf("(%s);created=%d;keyid=%q;alg=%q;nonce=%q",
+				quoteAll(components), o.clock.Now().Unix(), keyID, signatureAlg, nonce)
+			base, err := signatureBase(req, components, params)
+			if err != nil {
+				return nil, err
+			}
+
+			req.Header.Set("Signature-Input", signatureLabel+"="+params)
+			req.Header.Set("Signature", signatureLabel+"=:"+base64.StdEncoding.EncodeToString(sign(key, base))+":")
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// verifyOptions holds the optional configuration of a VerifySignature
+// middleware.
+type verifyOptions struct {
+	headers   []string
+	clock     Clock
+	skew      time.Duration
+	window    time.Duration
+	bodyLimit int64
+}
+
+// VerifyOption is a function that sets a VerifySignature option.
+type VerifyOption func(*verifyOptions)
+
+// WithVerifyHeaders sets VerifySignature to require that signatures cover the
+// header fields named in headers.
+func WithVerifyHeaders(headers ...string) VerifyOption {
+	return func(o *verifyOptions) { o.headers = headers }
+}
+
+// WithVerifyClock sets VerifySignature to tell time using clock.
+func WithVerifyClock(clock Clock) VerifyOption {
+	return func(o *verifyOptions) { o.clock = clock }
+}
+
+// WithVerifySkew sets how far in the future VerifySignature accepts a
+// signature's creation time, to allow for clocks that are not in sync.
+func WithVerifySkew(skew time.Duration) VerifyOption {
+	return func(o *verifyOptions) { o.skew = skew }
+}
+
+// WithVerifyReplayWindow sets how old a signature VerifySignature accepts.
+// Nonces are remembered for as long, so that no signature is accepted twice.
+func WithVerifyReplayWindow(window time.Duration) VerifyOption {
+	return func(o *verifyOptions) { o.window = window }
+}
+
+// WithVerifyBodyLimit sets the size in bytes of the largest body
+// VerifySignature reads to check its digest. Requests with larger bodies are
+// answered with 413 Content Too Large.
+func WithVerifyBodyLimit(limit int64) VerifyOption {
+	return func(o *verifyOptions) { o.bodyLimit = limit }
+}
+
+// VerifySignature returns middleware that verifies the signatures added by
+// Sign, looking up keys by the signature's key ID in keys. A request is
+// answered with 401 Unauthorized, without calling the handler, if its
+// signature is missing or invalid, does not cover the method, path, query,
+// Content-Digest and any header fields set with WithVerifyHeaders, was
+// created outside the skew and replay windows, repeats a nonce already
+// accepted, or if its body does not match Content-Digest. The handler gets
+// the body as sent.
+//
+// By default, VerifySignature uses SystemClock, allows 30 seconds of clock
+// skew, accepts signatures up to 5 minutes old, and reads bodies up to 10 MiB.
+func VerifySignature(keys SigningKeys, opts ...VerifyOption) func(h http.Handler) http.Handler {
+	o := verifyOptions{clock: SystemClock{}, skew: 30 * time.Second, window: 5 * time.Minute, bodyLimit: 10 << 20}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	required := append(append([]string(nil), signatureComponents...), lowerAll(o.headers)...)
+	v := &verifier{keys: keys, options: o, required: required, nonces: map[string]time.Time{}}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(io.LimitReader(r.Body, o.bodyLimit+1))
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > o.bodyLimit {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if err := v.verify(r, body); err != nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifier is the state of a VerifySignature middleware.
+type verifier struct {
+	keys     SigningKeys
+	options  verifyOptions
+	required []string
+
+	nonces    map[string]time.Time // by key ID and nonce, until when to keep
+	nextPrune time.Time
+	mutex     sync.Mutex
+}
+
+// verify returns an error unless r, with body, carries a valid signature.
+func (v *verifier) verify(r *http.Request, body []byte) error {
+	params, ok := strings.CutPrefix(r.Header.Get("Signature-Input"), signatureLabel+"=")
+	if !ok {
+		return errors.New("no signature input")
+	}
+	encoded, ok := strings.CutPrefix(r.Header.Get("Signature"), signatureLabel+"=:")
+	if !ok || !strings.HasSuffix(encoded, ":") {
+		return errors.New("no signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(encoded, ":"))
+	if err != nil {
+		return err
+	}
+
+	components, values, err := parseSignatureParams(params)
+	if err != nil {
+		return err
+	}
+	for _, c := range v.required {
+		if !slices.Contains(components, c) {
+			return fmt.Errorf("component %s not covered", c)
+		}
+	}
+	if values["alg"] != signatureAlg {
+		return fmt.Errorf("unsupported algorithm %q", values["alg"])
+	}
+	keyID, nonce := values["keyid"], values["nonce"]
+	if keyID == "" || nonce == "" {
+		return errors.New("no key ID or nonce")
+	}
+	createdUnix, err := strconv.ParseInt(values["created"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid creation time: %w", err)
+	}
+	created := time.Unix(createdUnix, 0)
+	now := v.options.clock.Now()
+	if created.After(now.Add(v.options.skew)) || created.Before(now.Add(-v.options.window)) {
+		return fmt.Errorf("creation time %v outside window", created)
+	}
+
+	if r.Header.Get("Content-Digest") != contentDigest(body) {
+		return errors.New("content digest mismatch")
+	}
+
+	key, err := v.keys.SigningKey(keyID)
+	if err != nil {
+		return err
+	}
+	base, err := signatureBase(r, components, params)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, sign(key, base)) {
+		return errors.New("signature mismatch")
+	}
+
+	return v.remember(keyID+" "+nonce, created.Add(v.options.window), now)
+}
+
+// remember records nonce until expiry, or returns an error if it is already
+// recorded. Expired nonces are pruned at most once per window.
+func (v *verifier) remember(nonce string, expiry, now time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if now.After(v.nextPrune) {
+		for n, until := range v.nonces {
+			if now.After(until) {
+				delete(v.nonces, n)
+			}
+		}
+		v.nextPrune = now.Add(v.options.window)
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return errors.New("nonce replayed")
+	}
+	v.nonces[nonce] = expiry
+	return nil
+}
+
+// signatureBase returns the RFC 9421 signature base of r for components,
+// ending with the signature parameters params.
+func signatureBase(r *http.Request, components []string, params string) (string, error) {
+	var b strings.Builder
+	for _, c := range components {
+		var value string
+		switch c {
+		case "@method":
+			value = r.Method
+		case "@path":
+			value = r.URL.EscapedPath()
+			if value == "" {
+				value = "/"
+			}
+		case "@query":
+			value = "?" + r.URL.RawQuery
+		default:
+			if strings.HasPrefix(c, "@") {
+				return "", fmt.Errorf("unsupported component %s", c)
+			}
+			// Values returns the request's own slice
+			fields := slices.Clone(r.Header.Values(c))
+			if len(fields) == 0 {
+				return "", fmt.Errorf("header field %s missing", c)
+			}
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			value = strings.Join(fields, ", ")
+		}
+		fmt.Fprintf(&b, "%q: %s\n", c, value)
+	}
+	fmt.Fprintf(&b, "%q: %s", "@signature-params", params)
+	return b.String(), nil
+}
+
+// parseSignatureParams parses the inner list of a Signature-Input member, as
+// written by Sign, into its components and parameters. Parameter values are
+// unquoted.
+func parseSignatureParams(params string) (components []string, values map[string]string, err error) {
+	list, rest, ok := strings.Cut(params, ")")
+	list, found := strings.CutPrefix(list, "(")
+	if !ok || !found {
+		return nil, nil, errors.New("invalid signature input")
+	}
+
+	for _, item := range strings.Fields(list) {
+		c, err := strconv.Unquote(item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid component %s", item)
+		}
+		components = append(components, c)
+	}
+
+	values = map[string]string{}
+	for _, param := range strings.Split(rest, ";")[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[name] = value
+	}
+
+	return components, values, nil
+}
+
+// contentDigest returns the RFC 9530 Content-Digest header field value for
+// body.
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// sign returns the HMAC-SHA256 of base with key.
+func sign(key []byte, base string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(base))
+	return mac.Sum(nil)
+}
+
+// newNonce returns 16 random bytes, base64url-encoded.
+func newNonce() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// lowerAll returns names in lower case, as RFC 9421 component names.
+func lowerAll(names []string) []string {
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	return lower
+}
+
+// quoteAll returns components quoted and separated by spaces.
+func quoteAll(components []string) string {
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = strconv.Quote(c)
+	}
+	return strings.Join(quoted, " ")
+}
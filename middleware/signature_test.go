@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/novrin/web/middleware/middlewaretest"
+)
+
+// tamper returns middleware that lets fn modify requests after signing.
+func tamper(fn func(r *http.Request)) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			fn(r)
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	keys := StaticSigningKeys{"k1": []byte("first key"), "k2": []byte("second key")}
+
+	tests := []struct {
+		name        string
+		keyID       string
+		signOpts    []SignOption
+		verifyOpts  []VerifyOption
+		signerKeys  SigningKeys
+		tamper      func(r *http.Request)
+		signedAt    time.Duration // relative to the verifier's clock
+		wantStatus  int
+		wantSendErr bool
+	}{
+		{name: "must_accept_signed_request", keyID: "k1", wantStatus: http.StatusOK},
+		{name: "must_accept_rotated_key", keyID: "k2", wantStatus: http.StatusOK},
+		{
+			name:       "must_accept_required_header",
+			keyID:      "k1",
+			signOpts:   []SignOption{WithSignHeaders("X-Tenant")},
+			verifyOpts: []VerifyOption{WithVerifyHeaders("x-tenant")},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "must_reject_uncovered_required_header",
+			keyID:      "k1",
+			verifyOpts: []VerifyOption{WithVerifyHeaders("X-Tenant")},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:        "must_fail_to_sign_missing_header",
+			keyID:       "k1",
+			signOpts:    []SignOption{WithSignHeaders("X-Missing")},
+			wantSendErr: true,
+		},
+		{
+			name:       "must_reject_unknown_key",
+			keyID:      "k3",
+			signerKeys: StaticSigningKeys{"k3": []byte("first key")},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_wrong_key",
+			keyID:      "k1",
+			signerKeys: StaticSigningKeys{"k1": []byte("other key")},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_changed_method",
+			keyID:      "k1",
+			tamper:     func(r *http.Request) { r.Method = http.MethodPut },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_changed_path",
+			keyID:      "k1",
+			tamper:     func(r *http.Request) { r.URL.Path = "/admin" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_changed_query",
+			keyID:      "k1",
+			tamper:     func(r *http.Request) { r.URL.RawQuery = "q=2" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_changed_header",
+			keyID:      "k1",
+			signOpts:   []SignOption{WithSignHeaders("X-Tenant")},
+			tamper:     func(r *http.Request) { r.Header.Set("X-Tenant", "other") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:  "must_reject_changed_body",
+			keyID: "k1",
+			tamper: func(r *http.Request) {
+				r.Body = io.NopCloser(strings.NewReader("forged"))
+				r.ContentLength = 6
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "must_reject_missing_signature",
+			keyID:      "k1",
+			tamper:     func(r *http.Request) { r.Header.Del("Signature") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{name: "must_accept_within_skew", keyID: "k1", signedAt: 30 * time.Second, wantStatus: http.StatusOK},
+		{name: "must_reject_beyond_skew", keyID: "k1", signedAt: 31 * time.Second, wantStatus: http.StatusUnauthorized},
+		{name: "must_accept_within_window", keyID: "k1", signedAt: -5 * time.Minute, wantStatus: http.StatusOK},
+		{name: "must_reject_beyond_window", keyID: "k1", signedAt: -5*time.Minute - time.Second, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+			verifyClock := middlewaretest.NewClock(now)
+			signClock := middlewaretest.NewClock(now.Add(tt.signedAt))
+
+			var gotBody string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			})
+			server := httptest.NewServer(VerifySignature(keys, append(tt.verifyOpts, WithVerifyClock(verifyClock))...)(handler))
+			defer server.Close()
+
+			signerKeys := tt.signerKeys
+			if signerKeys == nil {
+				signerKeys = keys
+			}
+			var transport http.RoundTripper = http.DefaultTransport
+			if tt.tamper != nil {
+				transport = tamper(tt.tamper)(transport)
+			}
+			transport = Sign(tt.keyID, signerKeys, append(tt.signOpts, WithSignClock(signClock))...)(transport)
+
+			r, _ := http.NewRequest(http.MethodPost, server.URL+"/orders?q=1", strings.NewReader(`{"id":1}`))
+			r.Header.Set("X-Tenant", "acme")
+			resp, err := transport.RoundTrip(r)
+			if tt.wantSendErr {
+				if err == nil {
+					t.Errorf("got error nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && gotBody != `{"id":1}` {
+				t.Errorf("got body '%v', want '%v'", gotBody, `{"id":1}`)
+			}
+		})
+	}
+}
+
+func TestVerifySignature_Replay(t *testing.T) {
+	keys := StaticSigningKeys{"k1": []byte("key")}
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var signed *http.Request
+	capture := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		signed = r
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/orders", nil)
+	if _, err := Sign("k1", keys, WithSignClock(clock))(capture).RoundTrip(r); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	verify := VerifySignature(keys, WithVerifyClock(clock))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header = signed.Header.Clone()
+		w := httptest.NewRecorder()
+		verify.ServeHTTP(w, req)
+
+		if w.Code != want {
+			t.Errorf("delivery %d: got status %v, want %v", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestVerifySignature_HeaderValues(t *testing.T) {
+	keys := StaticSigningKeys{"k1": []byte("key")}
+	clock := middlewaretest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var signed *http.Request
+	capture := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		signed = r
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/orders", nil)
+	r.Header["X-Tenant"] = []string{" acme "}
+	if _, err := Sign("k1", keys, WithSignHeaders("X-Tenant"), WithSignClock(clock))(capture).RoundTrip(r); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	// signing and verifying must leave the header values as they were sent
+	var got string
+	verify := VerifySignature(keys, WithVerifyClock(clock))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Tenant")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header = signed.Header.Clone()
+	w := httptest.NewRecorder()
+	verify.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusOK)
+	}
+	if got != " acme " {
+		t.Errorf("got X-Tenant '%v' in handler, want ' acme '", got)
+	}
+	if v := signed.Header.Get("X-Tenant"); v != " acme " {
+		t.Errorf("got X-Tenant '%v' in signed request, want ' acme '", v)
+	}
+}
+
+func TestVerifySignature_BodyLimit(t *testing.T) {
+	verify := VerifySignature(StaticSigningKeys{}, WithVerifyBodyLimit(4))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	verify.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long")))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestStaticSigningKeys(t *testing.T) {
+	keys := StaticSigningKeys{"k1": []byte("key")}
+
+	if key, err := keys.SigningKey("k1"); err != nil || string(key) != "key" {
+		t.Errorf("got key '%s' and error %v, want 'key' and nil", key, err)
+	}
+	if _, err := keys.SigningKey("k2"); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("got error %v, want %v", err, ErrUnknownSigningKey)
+	}
+}
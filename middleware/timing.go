@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings breaks a round trip down into the phases traced with httptrace. A
+// phase that did not happen, such as DNS on a reused connection, is 0.
+type Timings struct {
+	DNS          time.Duration // resolving the host
+	Connect      time.Duration // dialing the connection
+	TLS          time.Duration // the TLS handshake
+	WroteRequest time.Duration // from getting a connection to writing the request
+	FirstByte    time.Duration // from writing the request to the first response byte
+	Reused       bool          // whether the connection was reused
+}
+
+// attrs returns t as log fields.
+func (t Timings) attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.Duration("dns", t.DNS),
+		slog.Duration("connect", t.Connect),
+		slog.Duration("tls", t.TLS),
+		slog.Duration("wrote", t.WroteRequest),
+		slog.Duration("first-byte", t.FirstByte),
+		slog.Bool("reused", t.Reused),
+	}
+}
+
+// timingsKey is the context key under which Timing stores a timingTrace.
+type timingsKey struct{}
+
+// TimingsFromContext returns the Timings of the round trip whose request has
+// context ctx, and whether Timing traced it. It is typically called with the
+// context of a response's Request.
+func TimingsFromContext(ctx context.Context) (Timings, bool) {
+	t, ok := ctx.Value(timingsKey{}).(*timingTrace)
+	if !ok {
+		return Timings{}, false
+	}
+	return t.timings(), true
+}
+
+// Timing returns middleware that traces each round trip with httptrace and
+// records its Timings. They are retrievable with TimingsFromContext from the
+// context of the response's Request, and are logged by a RequestLogger placed
+// inside or outside Timing.
+func Timing() func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			t := &timingTrace{}
+			ctx := context.WithValue(r.Context(), timingsKey{}, t)
+			ctx = httptrace.WithClientTrace(ctx, t.clientTrace())
+
+			return next.RoundTrip(r.WithContext(ctx))
+		})
+	}
+}
+
+// timingTrace records the times of the httptrace events of one round trip,
+// and the connection it got. It backs both Timing and HARRecorder. Dials may
+// run on another goroutine, so all fields are guarded by mutex.
+type timingTrace struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, wrote, firstByte time.Time
+	reused                    bool
+	remote                    string // the server IP address
+	mutex                     sync.Mutex
+}
+
+func (t *timingTrace) clientTrace() *httptrace.ClientTrace {
+	at := func(field *time.Time) {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		*field = time.Now()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { at(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { at(&t.dnsDone) },
+		ConnectStart:      func(string, string) { at(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { at(&t.connectDone) },
+		TLSHandshakeStart: func() { at(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { at(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			at(&t.gotConn)
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.reused = info.Reused
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				t.remote = addr.IP.String()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { at(&t.wrote) },
+		GotFirstResponseByte: func() { at(&t.firstByte) },
+	}
+}
+
+// timings returns the durations between the recorded events.
+func (t *timingTrace) timings() Timings {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	between := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return max(to.Sub(from), 0)
+	}
+
+	return Timings{
+		DNS:          between(t.dnsStart, t.dnsDone),
+		Connect:      between(t.connectStart, t.connectDone),
+		TLS:          between(t.tlsStart, t.tlsDone),
+		WroteRequest: between(t.gotConn, t.wrote),
+		FirstByte:    between(t.wrote, t.firstByte),
+		Reused:       t.reused,
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTiming(t *testing.T) {
+	const think = 5 * time.Millisecond
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(think)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	client := &http.Client{Transport: RequestLogger(logger, "")(Timing()(server.Client().Transport))}
+
+	tests := []struct {
+		name       string
+		wantReused bool
+		wantTLS    bool
+	}{
+		{name: "must_time_new_connection", wantTLS: true},
+		{name: "must_time_reused_connection", wantReused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer buf.Reset()
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			timings, ok := TimingsFromContext(resp.Request.Context())
+			if !ok {
+				t.Fatalf("got no timings in response context, want timings")
+			}
+			if timings.Reused != tt.wantReused {
+				t.Errorf("got reused %v, want %v", timings.Reused, tt.wantReused)
+			}
+			if gotTLS := timings.TLS > 0; gotTLS != tt.wantTLS {
+				t.Errorf("got TLS %v, want handshake %v", timings.TLS, tt.wantTLS)
+			}
+			if timings.FirstByte < think {
+				t.Errorf("got first byte %v, want at least %v", timings.FirstByte, think)
+			}
+
+			got := buf.String()
+			for _, sub := range []string{"dns=", "connect=", "tls=", "wrote=", "first-byte=", "reused="} {
+				if !strings.Contains(got, sub) {
+					t.Errorf("'%s' does not contain '%s'", got, sub)
+				}
+			}
+		})
+	}
+}
+
+func TestTimingsFromContext(t *testing.T) {
+	if _, ok := TimingsFromContext(context.Background()); ok {
+		t.Errorf("got timings from untraced context, want none")
+	}
+}